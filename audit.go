@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type AuditConfig struct {
+	// A JSONL file that every eval and entity request is appended to (optional, nothing is written when empty)
+	File string `json:"file"`
+	// A URL that every audit entry is also POSTed to as JSON (optional)
+	Sink string `json:"sink"`
+}
+
+type AuditResult struct {
+	Cluster int    `json:"cluster"`
+	Error   string `json:"error,omitempty"`
+	// If the cluster did not respond in time
+	Timeout bool `json:"timeout,omitempty"`
+	// How long the cluster took to respond, in milliseconds
+	Duration int64 `json:"duration"`
+}
+
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// Either eval or entity
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+	// The name of the token used, for requests made through the HTTP API
+	Token string `json:"token,omitempty"`
+	// The name of the token that approved the eval, when approvals are required
+	ApprovedBy string `json:"approvedBy,omitempty"`
+	// The cluster that sent the request, for BroadcastEval packets
+	Cluster    *int                   `json:"cluster,omitempty"`
+	RemoteAddr string                 `json:"remoteAddr,omitempty"`
+	Code       string                 `json:"code,omitempty"`
+	Type       string                 `json:"type,omitempty"`
+	Args       map[string]interface{} `json:"args,omitempty"`
+	// How the entity cache handled the request, when caching is enabled for the entity
+	Cache string `json:"cache,omitempty"`
+	// Why the request was rejected before it was sent to any cluster
+	Error string `json:"error,omitempty"`
+	// The clusters the request was sent to
+	Targets []int         `json:"targets"`
+	Results []AuditResult `json:"results"`
+	// How long the whole request took, in milliseconds
+	Duration int64 `json:"duration"`
+}
+
+type Auditor struct {
+	mutex  *sync.Mutex
+	file   *os.File
+	sink   string
+	client *http.Client
+}
+
+var (
+	Audit *Auditor
+)
+
+func NewAuditor() {
+	if Audit != nil {
+		panic("Tried to initialise another auditor instance.")
+	}
+	Audit = &Auditor{
+		mutex:  &sync.Mutex{},
+		sink:   Config.Audit.Sink,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if Config.Audit.File != "" {
+		file, err := os.OpenFile(Config.Audit.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			logrus.Fatalf("Failed to open the audit log %s: %s", Config.Audit.File, err.Error())
+		}
+		Audit.file = file
+		logrus.Infof("Writing audit entries to %s", Config.Audit.File)
+	}
+}
+
+func NewAuditEntry(kind, id string) *AuditEntry {
+	return &AuditEntry{
+		Time:    time.Now(),
+		Kind:    kind,
+		ID:      id,
+		Targets: []int{},
+		Results: []AuditResult{},
+	}
+}
+
+// FromRequest records who made an HTTP API request.
+func (e *AuditEntry) FromRequest(token *ApiToken, r *http.Request) *AuditEntry {
+	e.Token = token.Name
+	e.RemoteAddr = r.RemoteAddr
+	return e
+}
+
+// FromCluster records the cluster that sent a request over its WebSocket.
+func (e *AuditEntry) FromCluster(c *Cluster) *AuditEntry {
+	id := c.ID
+	e.Cluster = &id
+	if c.Client != nil {
+		e.RemoteAddr = c.Client.RemoteAddr().String()
+	}
+	return e
+}
+
+// Record adds the outcome of sending a request to a cluster, start being when the request was sent.
+func (e *AuditEntry) Record(cluster int, err string, start time.Time) {
+	e.Results = append(e.Results, AuditResult{
+		Cluster:  cluster,
+		Error:    err,
+		Duration: time.Since(start).Milliseconds(),
+	})
+}
+
+// RecordTimeout adds a cluster that did not respond in time.
+func (e *AuditEntry) RecordTimeout(cluster int, err string, start time.Time) {
+	e.Record(cluster, err, start)
+	e.Results[len(e.Results)-1].Timeout = true
+}
+
+// Finish records a request that has been handled in the operator metrics and the audit log.
+func (e *AuditEntry) Finish() {
+	operatorMetrics.ObserveRequest(e)
+	Audit.Write(e)
+}
+
+// Write appends an entry to the audit log, and mirrors it to the sink if one is configured.
+func (a *Auditor) Write(e *AuditEntry) {
+	if a.file == nil && a.sink == "" {
+		return
+	}
+	e.Duration = time.Since(e.Time).Milliseconds()
+	marshaled, err := json.Marshal(e)
+	if err != nil {
+		logrus.Errorf("Failed to encode audit entry for %s %s: %s", e.Kind, e.ID, err.Error())
+		return
+	}
+	if a.file != nil {
+		a.mutex.Lock()
+		_, err = a.file.Write(append(marshaled, '\n'))
+		a.mutex.Unlock()
+		if err != nil {
+			logrus.Errorf("Failed to write audit entry for %s %s: %s", e.Kind, e.ID, err.Error())
+		}
+	}
+	if a.sink != "" {
+		go a.post(marshaled)
+	}
+}
+
+func (a *Auditor) post(body []byte) {
+	res, err := a.client.Post(a.sink, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		operatorMetrics.WebhookFailed("audit")
+		logrus.Errorf("Failed to post audit entry to the sink: %s", err.Error())
+		return
+	}
+	_ = res.Body.Close()
+	if res.StatusCode >= 300 {
+		operatorMetrics.WebhookFailed("audit")
+		logrus.Errorf("Audit sink responded with %s", res.Status)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+)
+
+type ApiToken struct {
+	// A name for this token, used in logs (REQUIRED)
+	Name string `json:"name"`
+	// The token that should be sent in the Authorization header (REQUIRED)
+	Token string `json:"token"`
+	// Overrides tokenRateLimit for this token (optional)
+	RateLimit *RateLimit `json:"rateLimit"`
+	limiter   *Limiter
+}
+
+// FindToken returns the configured token matching the value of an Authorization header.
+// The `auth` token from the config is always available under the name `default`.
+func FindToken(value string) *ApiToken {
+	if value == "" {
+		return nil
+	}
+	for i := range Config.Tokens {
+		if Config.Tokens[i].Token == value {
+			return &Config.Tokens[i]
+		}
+	}
+	return nil
+}
+
+// authorize checks the method and Authorization header of an API request, writing an error response when either is wrong.
+func authorize(w http.ResponseWriter, r *http.Request, method string) *ApiToken {
+	if r.Method != method {
+		writeJson(w, 405, ApiResponse{Error: true, Message: "Method not allowed"})
+		return nil
+	}
+	if r.Header.Get("Authorization") == "" {
+		writeJson(w, 403, ApiResponse{Error: true, Message: "Unauthorized"})
+		return nil
+	}
+	token := FindToken(r.Header.Get("Authorization"))
+	if token == nil {
+		writeJson(w, 403, ApiResponse{Error: true, Message: "Forbidden"})
+		return nil
+	}
+	return token
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	CacheHit       = "hit"
+	CacheStale     = "stale"
+	CacheMiss      = "miss"
+	CacheCoalesced = "coalesced"
+	CacheRefresh   = "refresh"
+)
+
+type cacheEntry struct {
+	results    []EntityResponse
+	fetched    time.Time
+	expires    time.Time
+	staleUntil time.Time
+	refreshing bool
+}
+
+type cacheCall struct {
+	done    chan struct{}
+	results []EntityResponse
+}
+
+// EntityCache holds entity responses for the entity types that have a cacheTTL set.
+// Concurrent requests for the same entity share a single broadcast to the clusters.
+type EntityCache struct {
+	mutex   *sync.Mutex
+	entries map[string]*cacheEntry
+	calls   map[string]*cacheCall
+}
+
+var entityCache = &EntityCache{
+	mutex:   &sync.Mutex{},
+	entries: make(map[string]*cacheEntry),
+	calls:   make(map[string]*cacheCall),
+}
+
+// entityCacheKey identifies an entity request by its type, args and target clusters.
+func entityCacheKey(req *EntityRequest) string {
+	// Maps are marshaled with sorted keys, so equal args always give the same key
+	key, _ := json.Marshal(struct {
+		Type     string                 `json:"type"`
+		Args     map[string]interface{} `json:"args"`
+		Clusters []int                  `json:"clusters"`
+	}{req.Type, req.Args, req.Clusters})
+	return string(key)
+}
+
+// Fetch returns the cached responses for key, calling fetch when there are none.
+// Stale responses are returned while fetch runs in the background, the status passed to fetch is either miss or refresh.
+func (c *EntityCache) Fetch(key string, entity *EntityType, fetch func(status string) []EntityResponse) ([]EntityResponse, string, time.Duration) {
+	c.mutex.Lock()
+	now := time.Now()
+	if entry, ok := c.entries[key]; ok && now.Before(entry.staleUntil) {
+		status := CacheHit
+		if !now.Before(entry.expires) {
+			status = CacheStale
+			if !entry.refreshing {
+				entry.refreshing = true
+				go c.load(key, entity, func() []EntityResponse {
+					return fetch(CacheRefresh)
+				})
+			}
+		}
+		c.mutex.Unlock()
+		return entry.results, status, now.Sub(entry.fetched)
+	}
+	c.mutex.Unlock()
+	results, leader := c.load(key, entity, func() []EntityResponse {
+		return fetch(CacheMiss)
+	})
+	if !leader {
+		return results, CacheCoalesced, 0
+	}
+	return results, CacheMiss, 0
+}
+
+// load runs fetch unless it's already running for key, in which case it waits for those results instead.
+func (c *EntityCache) load(key string, entity *EntityType, fetch func() []EntityResponse) ([]EntityResponse, bool) {
+	c.mutex.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mutex.Unlock()
+		<-call.done
+		return call.results, false
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mutex.Unlock()
+	call.results = fetch()
+	c.mutex.Lock()
+	delete(c.calls, key)
+	if cacheable(call.results) {
+		c.sweep()
+		now := time.Now()
+		c.entries[key] = &cacheEntry{
+			results:    call.results,
+			fetched:    now,
+			expires:    now.Add(time.Duration(entity.CacheTTL) * time.Millisecond),
+			staleUntil: now.Add(time.Duration(entity.CacheTTL+entity.StaleTTL) * time.Millisecond),
+		}
+	} else if entry, ok := c.entries[key]; ok {
+		entry.refreshing = false
+	}
+	c.mutex.Unlock()
+	close(call.done)
+	return call.results, true
+}
+
+// sweep removes every entry that can't be served anymore, the mutex must be held.
+func (c *EntityCache) sweep() {
+	now := time.Now()
+	for key, entry := range c.entries {
+		if !now.Before(entry.staleUntil) && !entry.refreshing {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// cacheable reports if every cluster responded without an error.
+func cacheable(results []EntityResponse) bool {
+	for _, res := range results {
+		if res.Error != "" {
+			return false
+		}
+	}
+	return len(results) > 0
+}
@@ -0,0 +1,116 @@
+// Package client connects Go services to the cluster operator, either as a cluster over /ws, or as a relay client over /relay.
+//
+// A cluster registers its handlers, connects, starts the shards it was given, and tells the operator when it's ready:
+//
+//	c := client.NewCluster("ws://localhost:3010/ws", "auth token")
+//	c.HandleEval(func(code string) (string, error) { ... })
+//	c.HandleEntity("guild", func(args map[string]interface{}) (interface{}, error) { ... })
+//	c.AddStatsProvider(func() map[string]interface{} { return map[string]interface{}{"messages": 42} })
+//	data, err := c.Connect(ctx)
+//	// start the shards in data.Block.Shards
+//	err = c.Ready()
+//	<-c.Done()
+//
+// Pings are acknowledged on their own. Nothing reconnects automatically, once Done is closed a new client has to connect.
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sync"
+)
+
+// The packet types of the cluster protocol, see implementation.md
+const (
+	Handshaking       = iota // client -> server
+	ShardData                // server -> client
+	Ping                     // server -> client
+	PingAck                  // client -> server
+	Eval                     // client -> server, server -> client
+	BroadcastEval            // client -> server
+	BroadcastEvalAck         // server -> client
+	Stats                    // server -> client
+	StatsAck                 // client -> server
+	Ready                    // client -> server
+	Entity                   // server -> client
+	EntityAck                // client -> server
+	MetricDescriptors        // client -> server
+	StatsIncrement           // client -> server
+	RelayMessage             // client -> server, server -> client
+)
+
+// ErrClosed is returned when writing to a connection that was closed.
+var ErrClosed = errors.New("connection closed")
+
+type Packet struct {
+	Type int             `json:"type"`
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// socket is a websocket connection that can be written to from several goroutines.
+type socket struct {
+	conn      *websocket.Conn
+	mutex     *sync.Mutex
+	done      chan struct{}
+	err       error
+	closeOnce *sync.Once
+}
+
+func dial(ctx context.Context, url, auth string) (*socket, error) {
+	header := http.Header{}
+	header.Set("Authorization", auth)
+	conn, res, err := websocket.DefaultDialer.DialContext(ctx, url, header)
+	if err != nil {
+		if res != nil {
+			return nil, fmt.Errorf("%w (%s)", err, res.Status)
+		}
+		return nil, err
+	}
+	return &socket{
+		conn:      conn,
+		mutex:     &sync.Mutex{},
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}, nil
+}
+
+func (s *socket) write(v interface{}) error {
+	select {
+	case <-s.done:
+		return ErrClosed
+	default:
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conn.WriteJSON(v)
+}
+
+// close closes the connection, err is why it was closed and is kept for Err.
+func (s *socket) close(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		_ = s.conn.Close()
+	})
+}
+
+// randomID generates the IDs requests are correlated with.
+func randomID() string {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", bytes)
+}
+
+// recovered turns a panic in a handler into an error, so it can be sent back instead of crashing the service.
+func recovered(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("panic: %v", r)
+	}
+}
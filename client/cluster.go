@@ -0,0 +1,383 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type ClusterShardData struct {
+	ID    int          `json:"id"`
+	Block ClusterBlock `json:"block"`
+}
+
+type ClusterBlock struct {
+	Shards []int `json:"shards"`
+	Total  int   `json:"total"`
+}
+
+type EvalRequest struct {
+	ID   string `json:"id"`
+	Code string `json:"code"`
+	// How long to wait for every cluster in milliseconds, for broadcast evals
+	Timeout int `json:"timeout,omitempty"`
+}
+
+type EvalRes struct {
+	ID    string `json:"id,omitempty"`
+	Res   string `json:"res,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type BroadcastEvalResponse struct {
+	ID      string    `json:"id"`
+	Error   string    `json:"error,omitempty"`
+	Results []EvalRes `json:"results"`
+}
+
+type EntityRequest struct {
+	ID   string                 `json:"id"`
+	Type string                 `json:"type"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+type EntityResponse struct {
+	ID    string      `json:"id"`
+	Error string      `json:"error,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// Metric describes a metric a cluster registers itself, with the same fields as the operator config.
+type Metric struct {
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Description string    `json:"description"`
+	Labels      []string  `json:"labels,omitempty"`
+	Buckets     []float64 `json:"buckets,omitempty"`
+	Quantiles   []float64 `json:"quantiles,omitempty"`
+}
+
+// EvalHandler evaluates code sent to every cluster, the error is sent back instead of the result when it isn't nil.
+type EvalHandler func(code string) (string, error)
+
+// EntityHandler responds to an entity request, the error is sent back instead of the data when it isn't nil.
+type EntityHandler func(args map[string]interface{}) (interface{}, error)
+
+// StatsProvider returns some of the stats a cluster reports, keyed by metric name.
+type StatsProvider func() map[string]interface{}
+
+// Cluster is a cluster connected to the operator over /ws.
+type Cluster struct {
+	url    string
+	auth   string
+	socket *socket
+	mutex  *sync.RWMutex
+	eval   EvalHandler
+	// Entity handlers by entity type
+	entities  map[string]EntityHandler
+	providers []StatsProvider
+	// Broadcast evals waiting for their results, by ID
+	broadcasts map[string]chan BroadcastEvalResponse
+	relay      *Relay
+	shardData  chan ClusterShardData
+}
+
+func NewCluster(url, auth string) *Cluster {
+	return &Cluster{
+		url:        url,
+		auth:       auth,
+		mutex:      &sync.RWMutex{},
+		entities:   make(map[string]EntityHandler),
+		broadcasts: make(map[string]chan BroadcastEvalResponse),
+		shardData:  make(chan ClusterShardData, 1),
+	}
+}
+
+// HandleEval sets the handler evals are sent to, evals are answered with an error without one.
+func (c *Cluster) HandleEval(handler EvalHandler) {
+	c.mutex.Lock()
+	c.eval = handler
+	c.mutex.Unlock()
+}
+
+// HandleEntity sets the handler for an entity type, requests for types without a handler are answered with an error.
+func (c *Cluster) HandleEntity(entityType string, handler EntityHandler) {
+	c.mutex.Lock()
+	c.entities[entityType] = handler
+	c.mutex.Unlock()
+}
+
+// AddStatsProvider adds a provider to the stats sent to the operator, the stats of every provider are merged.
+func (c *Cluster) AddStatsProvider(provider StatsProvider) {
+	c.mutex.Lock()
+	c.providers = append(c.providers, provider)
+	c.mutex.Unlock()
+}
+
+// Connect connects to the operator and waits for the shards this cluster should handle.
+// Handlers should be registered before, since the operator can send requests right after.
+func (c *Cluster) Connect(ctx context.Context) (ClusterShardData, error) {
+	if c.conn() != nil {
+		return ClusterShardData{}, errors.New("already connected")
+	}
+	s, err := dial(ctx, c.url, c.auth)
+	if err != nil {
+		return ClusterShardData{}, err
+	}
+	c.mutex.Lock()
+	if c.socket != nil {
+		c.mutex.Unlock()
+		s.close(ErrClosed)
+		return ClusterShardData{}, errors.New("already connected")
+	}
+	c.socket = s
+	c.mutex.Unlock()
+	go c.readLoop(s)
+	if err := c.write(Handshaking, nil); err != nil {
+		s.close(err)
+		return ClusterShardData{}, err
+	}
+	select {
+	case data := <-c.shardData:
+		return data, nil
+	case <-s.done:
+		return ClusterShardData{}, fmt.Errorf("disconnected before receiving shard data: %w", c.Err())
+	case <-ctx.Done():
+		s.close(ctx.Err())
+		return ClusterShardData{}, ctx.Err()
+	}
+}
+
+// Ready tells the operator every shard of this cluster is ready, the operator only starts pinging it from then on.
+func (c *Cluster) Ready() error {
+	return c.write(Ready, nil)
+}
+
+// PushStats sends the stats of every provider, without waiting for the operator to ask for them.
+func (c *Cluster) PushStats() error {
+	return c.write(StatsAck, c.stats())
+}
+
+// IncrementStats adds to counters, instead of replacing them like PushStats does.
+func (c *Cluster) IncrementStats(increments map[string]interface{}) error {
+	return c.write(StatsIncrement, increments)
+}
+
+// RegisterMetrics advertises metrics that aren't in the operator config, which only registers the ones matching its dynamicMetrics.
+func (c *Cluster) RegisterMetrics(metrics ...Metric) error {
+	return c.write(MetricDescriptors, metrics)
+}
+
+// BroadcastEval evaluates code on every cluster, waiting up to timeout for each of them.
+func (c *Cluster) BroadcastEval(ctx context.Context, code string, timeout time.Duration) ([]EvalRes, error) {
+	id := randomID()
+	ch := make(chan BroadcastEvalResponse, 1)
+	c.mutex.Lock()
+	c.broadcasts[id] = ch
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.broadcasts, id)
+		c.mutex.Unlock()
+	}()
+	err := c.write(BroadcastEval, EvalRequest{ID: id, Code: code, Timeout: int(timeout / time.Millisecond)})
+	if err != nil {
+		return nil, err
+	}
+	s := c.conn()
+	select {
+	case res := <-ch:
+		if res.Error != "" {
+			return nil, errors.New(res.Error)
+		}
+		return res.Results, nil
+	case <-s.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Relay returns a relay client using this cluster's connection, which joins the relay as cluster-<id> with the first packet it sends.
+// Its subscriptions are lost when the cluster disconnects.
+func (c *Cluster) Relay() *Relay {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.relay == nil {
+		c.relay = newRelay(func(packet RelayPacket) error {
+			return c.write(RelayMessage, packet)
+		})
+	}
+	return c.relay
+}
+
+// Done is closed once the connection to the operator is lost, it's nil until Connect is called.
+func (c *Cluster) Done() <-chan struct{} {
+	s := c.conn()
+	if s == nil {
+		return nil
+	}
+	return s.done
+}
+
+// Err returns why the connection was lost, once Done is closed.
+func (c *Cluster) Err() error {
+	s := c.conn()
+	if s == nil {
+		return nil
+	}
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+func (c *Cluster) Close() error {
+	if s := c.conn(); s != nil {
+		s.close(ErrClosed)
+	}
+	return nil
+}
+
+func (c *Cluster) conn() *socket {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.socket
+}
+
+func (c *Cluster) write(t int, body interface{}) error {
+	s := c.conn()
+	if s == nil {
+		return errors.New("not connected")
+	}
+	packet := struct {
+		Type int         `json:"type"`
+		Body interface{} `json:"body,omitempty"`
+	}{Type: t, Body: body}
+	return s.write(packet)
+}
+
+func (c *Cluster) stats() map[string]interface{} {
+	c.mutex.RLock()
+	providers := c.providers
+	c.mutex.RUnlock()
+	stats := make(map[string]interface{})
+	for _, provider := range providers {
+		for name, value := range provider() {
+			stats[name] = value
+		}
+	}
+	return stats
+}
+
+func (c *Cluster) readLoop(s *socket) {
+	for {
+		packet := Packet{}
+		if err := s.conn.ReadJSON(&packet); err != nil {
+			s.close(err)
+			c.mutex.RLock()
+			if c.relay != nil {
+				close(c.relay.queue)
+			}
+			c.mutex.RUnlock()
+			return
+		}
+		switch packet.Type {
+		case Ping:
+			_ = c.write(PingAck, nil)
+		case ShardData:
+			data := ClusterShardData{}
+			if err := json.Unmarshal(packet.Body, &data); err == nil {
+				select {
+				case c.shardData <- data:
+				default:
+				}
+			}
+		case RelayMessage:
+			// Relay messages are handed to the relay in order, instead of being handled concurrently
+			relayPacket := &RelayPacket{}
+			if err := json.Unmarshal(packet.Body, relayPacket); err != nil {
+				break
+			}
+			c.mutex.RLock()
+			relay := c.relay
+			c.mutex.RUnlock()
+			if relay != nil {
+				relay.receive(relayPacket)
+			}
+		default:
+			go c.handle(packet)
+		}
+	}
+}
+
+// handle acts on the packets that can take a while, so they don't hold up pings.
+func (c *Cluster) handle(packet Packet) {
+	switch packet.Type {
+	case Stats:
+		_ = c.PushStats()
+	case Eval:
+		req := EvalRequest{}
+		if err := json.Unmarshal(packet.Body, &req); err != nil {
+			return
+		}
+		res := EvalRes{ID: req.ID}
+		c.mutex.RLock()
+		handler := c.eval
+		c.mutex.RUnlock()
+		if handler == nil {
+			res.Error = "eval is not supported"
+		} else if out, err := runEval(handler, req.Code); err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Res = out
+		}
+		_ = c.write(Eval, res)
+	case BroadcastEvalAck:
+		res := BroadcastEvalResponse{}
+		if err := json.Unmarshal(packet.Body, &res); err != nil {
+			return
+		}
+		c.mutex.RLock()
+		ch, ok := c.broadcasts[res.ID]
+		c.mutex.RUnlock()
+		if ok {
+			select {
+			case ch <- res:
+			default:
+			}
+		}
+	case Entity:
+		req := EntityRequest{}
+		if err := json.Unmarshal(packet.Body, &req); err != nil {
+			return
+		}
+		res := EntityResponse{ID: req.ID}
+		c.mutex.RLock()
+		handler, ok := c.entities[req.Type]
+		c.mutex.RUnlock()
+		if !ok {
+			res.Error = fmt.Sprintf("unknown entity type %s", req.Type)
+		} else if data, err := runEntity(handler, req.Args); err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Data = data
+		}
+		_ = c.write(EntityAck, res)
+	}
+}
+
+func runEval(handler EvalHandler, code string) (res string, err error) {
+	defer recovered(&err)
+	return handler(code)
+}
+
+func runEntity(handler EntityHandler, args map[string]interface{}) (data interface{}, err error) {
+	defer recovered(&err)
+	return handler(args)
+}
@@ -0,0 +1,289 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// operator is a stand-in for the cluster operator, handing every connection it accepts to the test.
+type operator struct {
+	server *httptest.Server
+	conns  chan *websocket.Conn
+}
+
+func newOperator(t *testing.T) *operator {
+	o := &operator{conns: make(chan *websocket.Conn, 1)}
+	upgrader := websocket.Upgrader{}
+	o.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The operator rejects clusters before upgrading the connection
+		if r.Header.Get("Authorization") != "secret" {
+			w.WriteHeader(403)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		o.conns <- conn
+	}))
+	t.Cleanup(o.server.Close)
+	return o
+}
+
+func (o *operator) url() string {
+	return "ws" + strings.TrimPrefix(o.server.URL, "http")
+}
+
+func (o *operator) accept(t *testing.T) *websocket.Conn {
+	select {
+	case conn := <-o.conns:
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	case <-time.After(2 * time.Second):
+		t.Fatal("the client did not connect")
+		return nil
+	}
+}
+
+func send(t *testing.T, conn *websocket.Conn, packetType int, body interface{}) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(Packet{Type: packetType, Body: raw}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expect reads packets until one of the type arrives, failing if none does within 2 seconds.
+func expect(t *testing.T, conn *websocket.Conn, packetType int) Packet {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		packet := Packet{}
+		if err := conn.ReadJSON(&packet); err != nil {
+			t.Fatalf("expected a type %d packet: %v", packetType, err)
+		}
+		if packet.Type == packetType {
+			return packet
+		}
+	}
+}
+
+// connect connects a cluster to the operator, going through the handshake.
+func connect(t *testing.T, o *operator, c *Cluster) (*websocket.Conn, ClusterShardData) {
+	type result struct {
+		data ClusterShardData
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		data, err := c.Connect(context.Background())
+		done <- result{data, err}
+	}()
+	conn := o.accept(t)
+	expect(t, conn, Handshaking)
+	send(t, conn, ShardData, ClusterShardData{ID: 1, Block: ClusterBlock{Shards: []int{2, 3}, Total: 4}})
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return conn, res.data
+}
+
+func TestClusterHandshakePingEval(t *testing.T) {
+	o := newOperator(t)
+	c := NewCluster(o.url(), "secret")
+	c.HandleEval(func(code string) (string, error) {
+		if code == "panic" {
+			panic("eval failed")
+		}
+		return "evaluated " + code, nil
+	})
+	c.AddStatsProvider(func() map[string]interface{} {
+		return map[string]interface{}{"messages": 42}
+	})
+	conn, data := connect(t, o, c)
+	want := ClusterShardData{ID: 1, Block: ClusterBlock{Shards: []int{2, 3}, Total: 4}}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("shard data = %+v, want %+v", data, want)
+	}
+
+	if err := c.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, conn, Ready)
+
+	send(t, conn, Ping, nil)
+	expect(t, conn, PingAck)
+
+	send(t, conn, Eval, EvalRequest{ID: "1", Code: "1 + 1"})
+	res := EvalRes{}
+	if err := json.Unmarshal(expect(t, conn, Eval).Body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res != (EvalRes{ID: "1", Res: "evaluated 1 + 1"}) {
+		t.Errorf("eval response = %+v", res)
+	}
+
+	send(t, conn, Eval, EvalRequest{ID: "2", Code: "panic"})
+	res = EvalRes{}
+	if err := json.Unmarshal(expect(t, conn, Eval).Body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res != (EvalRes{ID: "2", Error: "panic: eval failed"}) {
+		t.Errorf("eval response = %+v", res)
+	}
+
+	send(t, conn, Stats, nil)
+	stats := make(map[string]interface{})
+	if err := json.Unmarshal(expect(t, conn, StatsAck).Body, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats["messages"] != float64(42) {
+		t.Errorf("stats = %v", stats)
+	}
+}
+
+func TestClusterEntity(t *testing.T) {
+	o := newOperator(t)
+	c := NewCluster(o.url(), "secret")
+	c.HandleEntity("guild", func(args map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"id": args["id"]}, nil
+	})
+	conn, _ := connect(t, o, c)
+
+	send(t, conn, Entity, EntityRequest{ID: "1", Type: "guild", Args: map[string]interface{}{"id": "5"}})
+	res := EntityResponse{}
+	if err := json.Unmarshal(expect(t, conn, EntityAck).Body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != "1" || !reflect.DeepEqual(res.Data, map[string]interface{}{"id": "5"}) {
+		t.Errorf("entity response = %+v", res)
+	}
+
+	send(t, conn, Entity, EntityRequest{ID: "2", Type: "user"})
+	res = EntityResponse{}
+	if err := json.Unmarshal(expect(t, conn, EntityAck).Body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != "2" || res.Error != "unknown entity type user" {
+		t.Errorf("entity response = %+v", res)
+	}
+}
+
+// A relay handler that doesn't return must not stop the cluster from acknowledging pings.
+func TestClusterPingWhileRelayIsBehind(t *testing.T) {
+	o := newOperator(t)
+	c := NewCluster(o.url(), "secret")
+	conn, _ := connect(t, o, c)
+	release := make(chan struct{})
+	defer close(release)
+	relay := c.Relay()
+	if err := relay.Subscribe("events", func(packet *RelayPacket) {
+		<-release
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, conn, RelayMessage)
+
+	for i := 0; i < relayQueueSize+10; i++ {
+		send(t, conn, RelayMessage, RelayPacket{Type: RelayReceive, Topic: "events", Seq: uint64(i + 1)})
+	}
+	send(t, conn, Ping, nil)
+	expect(t, conn, PingAck)
+	if relay.Dropped() == 0 {
+		t.Error("expected packets to be dropped once the queue was full")
+	}
+}
+
+func TestClusterBeforeConnect(t *testing.T) {
+	c := NewCluster("ws://127.0.0.1:0/ws", "secret")
+	if c.Done() != nil {
+		t.Error("Done should be nil before connecting")
+	}
+	if c.Err() != nil {
+		t.Error("Err should be nil before connecting")
+	}
+	if err := c.Ready(); err == nil {
+		t.Error("Ready should fail before connecting")
+	}
+	if err := c.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClusterForbidden(t *testing.T) {
+	o := newOperator(t)
+	c := NewCluster(o.url(), "wrong")
+	if _, err := c.Connect(context.Background()); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected a 403 error, got %v", err)
+	}
+}
+
+func TestDialRelay(t *testing.T) {
+	o := newOperator(t)
+	done := make(chan *Relay, 1)
+	go func() {
+		r, err := DialRelay(context.Background(), o.url(), "secret")
+		if err != nil {
+			t.Error(err)
+		}
+		done <- r
+	}()
+	conn := o.accept(t)
+	if err := conn.WriteJSON(RelayPacket{Type: RelayWelcome, ID: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	r := <-done
+	if r == nil {
+		return
+	}
+	defer r.Close()
+	if r.ID() != "abc" {
+		t.Errorf("ID = %q, want abc", r.ID())
+	}
+
+	received := make(chan *RelayPacket, 1)
+	if err := r.Subscribe("guilds.*", func(packet *RelayPacket) {
+		received <- packet
+	}); err != nil {
+		t.Fatal(err)
+	}
+	subscribe := RelayPacket{}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&subscribe); err != nil {
+		t.Fatal(err)
+	}
+	if subscribe.Type != RelaySubscribe || !reflect.DeepEqual(subscribe.Topics, []string{"guilds.*"}) {
+		t.Errorf("subscribe packet = %+v", subscribe)
+	}
+
+	if err := conn.WriteJSON(RelayPacket{Type: RelayReceive, ID: "key", Topic: "guilds.create", Ack: true, Body: json.RawMessage(`"hi"`)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case packet := <-received:
+		if string(packet.Body) != `"hi"` {
+			t.Errorf("body = %s", packet.Body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the subscription did not receive the message")
+	}
+	ack := RelayPacket{}
+	if err := conn.ReadJSON(&ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.Type != RelayAck || ack.ID != "key" {
+		t.Errorf("ack packet = %+v", ack)
+	}
+}
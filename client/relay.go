@@ -0,0 +1,277 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sync"
+	"sync/atomic"
+)
+
+// The packet types of the relay, see relay.md
+const (
+	RelayDispatch    = iota // client -> relay
+	RelayReceive            // relay -> client
+	RelaySubscribe          // client -> relay
+	RelayUnsubscribe        // client -> relay
+	RelayDirect             // client -> relay, relay -> client
+	RelayRequest            // client -> relay, relay -> client
+	RelayReply              // client -> relay, relay -> client
+	RelayError              // relay -> client
+	RelayRegister           // client -> relay
+	RelayWelcome            // relay -> client
+	RelayIdentify           // client -> relay
+	RelayPresence           // relay -> client
+	RelayResume             // client -> relay
+	RelayReceipt            // relay -> client
+	RelayAck                // client -> relay
+)
+
+type RelayPacket struct {
+	Type     int                    `json:"type"`
+	ID       string                 `json:"id,omitempty"`
+	Topic    string                 `json:"topic,omitempty"`
+	Topics   []string               `json:"topics,omitempty"`
+	To       string                 `json:"to,omitempty"`
+	Service  string                 `json:"service,omitempty"`
+	Services []string               `json:"services,omitempty"`
+	From     string                 `json:"from,omitempty"`
+	Timeout  int                    `json:"timeout,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	Name     string                 `json:"name,omitempty"`
+	Role     string                 `json:"role,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	Seq      uint64                 `json:"seq,omitempty"`
+	// The cluster that sent a message, when it was sent over a cluster's /ws connection
+	Cluster    *int            `json:"cluster,omitempty"`
+	Ack        bool            `json:"ack,omitempty"`
+	Recipients *int            `json:"recipients,omitempty"`
+	Acked      []string        `json:"acked,omitempty"`
+	Missing    []string        `json:"missing,omitempty"`
+	Final      bool            `json:"final,omitempty"`
+	Replayed   bool            `json:"replayed,omitempty"`
+	Event      string          `json:"event,omitempty"`
+	Client     json.RawMessage `json:"client,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+}
+
+// RelayHandlerFunc handles a packet the relay sent, it's called on the relay's own goroutine, so packets are handled in order.
+// Handlers should return quickly, packets are dropped when they fall too far behind.
+type RelayHandlerFunc func(packet *RelayPacket)
+
+type relaySubscription struct {
+	topic   string
+	handler RelayHandlerFunc
+}
+
+// Relay is a client of the relay, connected either over /relay, or over a cluster's /ws connection.
+type Relay struct {
+	// Packets dropped because the handlers were too far behind, first so it's aligned for atomic operations
+	dropped uint64
+	send    func(packet RelayPacket) error
+	socket  *socket
+	mutex   *sync.RWMutex
+	id      string
+	// The welcome packet was received, and id is set
+	welcome       chan struct{}
+	welcomeOnce   *sync.Once
+	subscriptions []relaySubscription
+	// Called with messages no subscription matched, such as messages without a topic
+	fallback RelayHandlerFunc
+	// Called with every other packet, such as errors, receipts and direct messages
+	packets RelayHandlerFunc
+	queue   chan *RelayPacket
+}
+
+// How many received packets can wait for their handlers, packets received once the queue is full are dropped.
+// The connection is never left unread, as for a cluster's relay, that would stop pings from being acknowledged.
+const relayQueueSize = 256
+
+func newRelay(send func(packet RelayPacket) error) *Relay {
+	r := &Relay{
+		send:        send,
+		mutex:       &sync.RWMutex{},
+		welcome:     make(chan struct{}),
+		welcomeOnce: &sync.Once{},
+		queue:       make(chan *RelayPacket, relayQueueSize),
+	}
+	go r.dispatchLoop()
+	return r
+}
+
+// DialRelay connects to the relay over /relay, and waits for the ID it's given.
+func DialRelay(ctx context.Context, url, auth string) (*Relay, error) {
+	s, err := dial(ctx, url, auth)
+	if err != nil {
+		return nil, err
+	}
+	r := newRelay(func(packet RelayPacket) error {
+		return s.write(packet)
+	})
+	r.socket = s
+	go r.readLoop()
+	select {
+	case <-r.welcome:
+		return r, nil
+	case <-s.done:
+		return nil, s.err
+	case <-ctx.Done():
+		s.close(ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// ID returns the ID the relay gave this client, which is empty until the relay sent it.
+func (r *Relay) ID() string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.id
+}
+
+// Publish dispatches a message to the subscribers of a topic, or to every client when the topic is empty.
+func (r *Relay) Publish(topic string, body interface{}) error {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return r.Send(RelayPacket{Type: RelayDispatch, Topic: topic, Body: raw})
+}
+
+// Subscribe subscribes to a topic name or pattern, such as guilds.*, and calls handler with every message matching it.
+// A message matching several subscriptions is handed to each of them.
+func (r *Relay) Subscribe(topic string, handler RelayHandlerFunc) error {
+	if _, err := path.Match(topic, ""); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.subscriptions = append(r.subscriptions, relaySubscription{topic: topic, handler: handler})
+	r.mutex.Unlock()
+	return r.Send(RelayPacket{Type: RelaySubscribe, Topics: []string{topic}})
+}
+
+// Unsubscribe removes every subscription to a topic name or pattern, it has to be the same as the one subscribed to.
+func (r *Relay) Unsubscribe(topic string) error {
+	r.mutex.Lock()
+	subscriptions := make([]relaySubscription, 0, len(r.subscriptions))
+	for _, s := range r.subscriptions {
+		if s.topic != topic {
+			subscriptions = append(subscriptions, s)
+		}
+	}
+	r.subscriptions = subscriptions
+	r.mutex.Unlock()
+	return r.Send(RelayPacket{Type: RelayUnsubscribe, Topics: []string{topic}})
+}
+
+// HandleMessages sets the handler for messages no subscription matched, which includes messages sent without a topic.
+func (r *Relay) HandleMessages(handler RelayHandlerFunc) {
+	r.mutex.Lock()
+	r.fallback = handler
+	r.mutex.Unlock()
+}
+
+// HandlePackets sets the handler for every packet that isn't a message, such as errors, receipts, presence events and direct messages.
+func (r *Relay) HandlePackets(handler RelayHandlerFunc) {
+	r.mutex.Lock()
+	r.packets = handler
+	r.mutex.Unlock()
+}
+
+// Send sends any relay packet, for the parts of the relay this client doesn't wrap.
+func (r *Relay) Send(packet RelayPacket) error {
+	return r.send(packet)
+}
+
+// Done is closed once the connection to the relay is lost, for clients connected over /relay.
+// It's nil for a cluster's relay, which is connected as long as the cluster is.
+func (r *Relay) Done() <-chan struct{} {
+	if r.socket == nil {
+		return nil
+	}
+	return r.socket.done
+}
+
+// Close disconnects a client connected over /relay, a cluster's relay is closed with the cluster.
+func (r *Relay) Close() error {
+	if r.socket != nil {
+		r.socket.close(ErrClosed)
+	}
+	return nil
+}
+
+func (r *Relay) readLoop() {
+	defer close(r.queue)
+	for {
+		packet := &RelayPacket{}
+		if err := r.socket.conn.ReadJSON(packet); err != nil {
+			r.socket.close(err)
+			return
+		}
+		r.receive(packet)
+	}
+}
+
+// receive queues a packet for the handlers, dropping it when they're behind by relayQueueSize packets.
+func (r *Relay) receive(packet *RelayPacket) {
+	if packet.Type == RelayWelcome {
+		r.mutex.Lock()
+		r.id = packet.ID
+		r.mutex.Unlock()
+		r.welcomeOnce.Do(func() {
+			close(r.welcome)
+		})
+		return
+	}
+	select {
+	case r.queue <- packet:
+	default:
+		atomic.AddUint64(&r.dropped, 1)
+	}
+}
+
+// Dropped returns how many packets were dropped because the handlers couldn't keep up.
+// Dropped messages that asked for an acknowledgement aren't acknowledged, so their sender sees them as missing.
+func (r *Relay) Dropped() uint64 {
+	return atomic.LoadUint64(&r.dropped)
+}
+
+func (r *Relay) dispatchLoop() {
+	for packet := range r.queue {
+		r.handle(packet)
+	}
+}
+
+func (r *Relay) handle(packet *RelayPacket) {
+	r.mutex.RLock()
+	handlers := make([]RelayHandlerFunc, 0, 1)
+	if packet.Type == RelayReceive {
+		for _, s := range r.subscriptions {
+			if ok, _ := path.Match(s.topic, packet.Topic); packet.Topic != "" && (ok || s.topic == packet.Topic) {
+				handlers = append(handlers, s.handler)
+			}
+		}
+		if len(handlers) < 1 && r.fallback != nil {
+			handlers = append(handlers, r.fallback)
+		}
+	} else if r.packets != nil {
+		handlers = append(handlers, r.packets)
+	}
+	r.mutex.RUnlock()
+	for _, handler := range handlers {
+		handler(packet)
+	}
+	// Messages that ask for an acknowledgement are acknowledged once they were handled
+	if packet.Type == RelayReceive && packet.Ack && packet.ID != "" {
+		_ = r.Send(RelayPacket{Type: RelayAck, ID: packet.ID})
+	}
+}
+
+// WaitWelcome waits until the relay gave this client its ID, which for a cluster's relay happens after the first packet it sends.
+func (r *Relay) WaitWelcome(ctx context.Context) (string, error) {
+	select {
+	case <-r.welcome:
+		return r.ID(), nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
@@ -33,6 +33,8 @@ type Cluster struct {
 	Block      ClusterBlock    `json:"block"`
 	State      ClusterState    `json:"state"`
 	pingTicker *time.Ticker
+	pingSent   time.Time
+	connects   int
 	mutex      *sync.Mutex
 	statsChan  chan map[string]interface{}
 }
@@ -41,6 +43,8 @@ type EntityRequest struct {
 	ID   string                 `json:"id,omitempty"`
 	Type string                 `json:"type"`
 	Args map[string]interface{} `json:"args,omitempty"`
+	// The clusters to send the request to, every cluster when empty
+	Clusters []int `json:"clusters,omitempty"`
 }
 
 type EntityResponse struct {
@@ -57,6 +61,7 @@ type BroadcastEvalRequest struct {
 
 type BroadcastEvalResponse struct {
 	ID      string    `json:"id"`
+	Error   string    `json:"error,omitempty"`
 	Results []EvalRes `json:"results"`
 }
 
@@ -72,6 +77,19 @@ type ApiResponse struct {
 	Data    interface{} `json:"data,omitempty"`
 }
 
+// Targets reports if the request should be sent to a cluster.
+func (r *EntityRequest) Targets(id int) bool {
+	if len(r.Clusters) < 1 {
+		return true
+	}
+	for _, c := range r.Clusters {
+		if c == id {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Cluster) Terminate() {
 	c.TerminateWithReason(0, "", "disconnected")
 }
@@ -85,11 +103,14 @@ func (c *Cluster) TerminateWithReason(code int, reason, logReason string) {
 		_ = c.Client.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
 	}
 	_ = c.Client.Close()
+	Relay.RemoveCluster(c)
 	if c.ID >= 0 && c.ID < len(Server.Clients) {
 		Log.PostLog(c, ColorDisconnecting, logReason)
 	}
 	c.State = ClusterWaiting
 	c.pingTicker = nil
+	c.pingSent = time.Time{}
+	Metrics.Forget(c)
 }
 
 func (c *Cluster) FirstShardID() int {
@@ -121,10 +142,32 @@ func (c *Cluster) HandleMessage(msg *Packet) {
 		if err != nil {
 			break
 		}
-		c.statsChan <- stats
+		Metrics.Push(c, stats)
+		// Lets RequestStats know the cluster responded, if it's waiting
+		select {
+		case c.statsChan <- stats:
+		default:
+		}
+		break
+	case StatsIncrement:
+		bytes, err := json.Marshal(msg.Body)
+		if err != nil {
+			break
+		}
+		increments := make(map[string]interface{})
+		err = json.Unmarshal(bytes, &increments)
+		if err != nil {
+			break
+		}
+		Metrics.Increment(c, increments)
 		break
 	case PingAck:
 		c.PingRecv = true
+		// Acks without a ping waiting for one, like a second ack for the same ping, have no round trip to measure
+		if !c.pingSent.IsZero() {
+			operatorMetrics.ObservePing(c, time.Since(c.pingSent))
+			c.pingSent = time.Time{}
+		}
 		break
 	case Ready:
 		c.State = ClusterReady
@@ -141,40 +184,20 @@ func (c *Cluster) HandleMessage(msg *Packet) {
 			if err != nil {
 				break
 			}
-			Server.PutEvalChan(req.ID)
-			results := make([]EvalRes, 0, len(Server.Clients))
-			for _, cluster := range Server.Clients {
-				if cluster.State == ClusterWaiting || cluster.State == ClusterConnecting {
-					results = append(results, EvalRes{
-						Error: "Cluster is not ready!",
-					})
-					continue
-				}
-				cluster.Write(Eval, BroadcastEvalRequest{
+			entry := NewAuditEntry("eval", req.ID).FromCluster(c)
+			entry.Code = req.Code
+			if err := Config.EvalPolicy.Check(req.Code); err != nil {
+				entry.Error = err.Error()
+				entry.Finish()
+				c.Write(BroadcastEvalAck, BroadcastEvalResponse{
 					ID:      req.ID,
-					Code:    req.Code,
-					Timeout: -1,
+					Error:   err.Error(),
+					Results: []EvalRes{},
 				})
-				select {
-				case resp := <-Server.GetEvalChan(req.ID):
-					{
-						results = append(results, EvalRes{
-							ID:    "",
-							Res:   resp.Res,
-							Error: resp.Error,
-						})
-						break
-					}
-				case <-time.After(time.Duration(req.Timeout) * time.Millisecond):
-					{
-						results = append(results, EvalRes{
-							Error: "Response timed out",
-						})
-						break
-					}
-				}
+				break
 			}
-			Server.DeleteEvalChan(req.ID)
+			results := Server.BroadcastEval(req, time.Duration(req.Timeout)*time.Millisecond, entry)
+			entry.Finish()
 			c.Write(BroadcastEvalAck, BroadcastEvalResponse{
 				ID:      req.ID,
 				Results: results,
@@ -193,6 +216,29 @@ func (c *Cluster) HandleMessage(msg *Packet) {
 		if c := Server.GetEvalChan(res.ID); c != nil {
 			c <- res
 		}
+	case MetricDescriptors:
+		bytes, err := json.Marshal(msg.Body)
+		if err != nil {
+			break
+		}
+		metrics := make([]Metric, 0)
+		err = json.Unmarshal(bytes, &metrics)
+		if err != nil {
+			logrus.Debugf("Cluster %d sent metric descriptors that could not be decoded: %s", c.ID, err.Error())
+			break
+		}
+		Metrics.RegisterDynamic(c, metrics)
+	case RelayMessage:
+		bytes, err := json.Marshal(msg.Body)
+		if err != nil {
+			break
+		}
+		packet := &RelayPacket{}
+		err = json.Unmarshal(bytes, packet)
+		if err != nil {
+			break
+		}
+		Relay.HandleCluster(c, packet)
 	case EntityAck:
 		bytes, err := json.Marshal(msg.Body)
 		if err != nil {
@@ -219,13 +265,17 @@ func (c *Cluster) Write(t int, data interface{}) {
 	c.mutex.Unlock()
 }
 
-func (c *Cluster) RequestStats() map[string]interface{} {
+func (c *Cluster) RequestStats(timeout time.Duration) map[string]interface{} {
 	if c.Client != nil {
+		select {
+		case <-c.statsChan:
+		default:
+		}
 		c.Write(Stats, nil)
 		select {
 		case stats := <-c.statsChan:
 			return stats
-		case <-time.After(5 * time.Second):
+		case <-time.After(timeout):
 			return nil
 		}
 	}
@@ -233,6 +283,8 @@ func (c *Cluster) RequestStats() map[string]interface{} {
 }
 
 func (c *Cluster) StartHealthCheck() {
+	// No ping has been sent yet, so the first check shouldn't count as a missed ping
+	c.PingRecv = true
 	c.pingTicker = time.NewTicker(5 * time.Second)
 	go func() {
 		for {
@@ -244,10 +296,12 @@ func (c *Cluster) StartHealthCheck() {
 				{
 					if c.State == ClusterReady {
 						if !c.PingRecv {
+							operatorMetrics.MissedPing(c)
 							logrus.Warnf("Cluster %d has not responded to the last ping, terminating connection...", c.ID)
 							c.TerminateWithReason(4001, "No ping received", "unhealthy")
 						}
 						c.PingRecv = false
+						c.pingSent = time.Now()
 						c.Write(Ping, nil)
 					}
 				}
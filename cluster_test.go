@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pingsObserved returns how many round trips were recorded for a cluster, and their sum in seconds.
+func pingsObserved(t *testing.T, c *Cluster) (uint64, float64) {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := operatorMetrics.pingRTT.WithLabelValues(strconv.Itoa(c.ID)).(prometheus.Metric).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.Histogram.GetSampleCount(), m.Histogram.GetSampleSum()
+}
+
+// Only acks for a ping that was sent are measured, once each.
+func TestPingRTT(t *testing.T) {
+	if operatorMetrics == nil {
+		NewOperatorMetrics()
+	}
+	c := &Cluster{ID: 7, State: ClusterReady, mutex: &sync.Mutex{}}
+	before, beforeSum := pingsObserved(t, c)
+	c.HandleMessage(&Packet{Type: PingAck})
+	if count, _ := pingsObserved(t, c); count != before {
+		t.Fatalf("an ack without a ping was measured")
+	}
+
+	c.pingSent = time.Now().Add(-50 * time.Millisecond)
+	c.HandleMessage(&Packet{Type: PingAck})
+	c.HandleMessage(&Packet{Type: PingAck})
+	count, sum := pingsObserved(t, c)
+	if count != before+1 {
+		t.Fatalf("measured %d round trips, want 1", count-before)
+	}
+	if rtt := sum - beforeSum; rtt < 0.05 || rtt > 1 {
+		t.Errorf("round trip = %vs, want about 0.05s", rtt)
+	}
+}
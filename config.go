@@ -2,8 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/sirupsen/logrus"
+	"net/url"
 	"os"
+	"path"
 )
 
 var Config OperatorConfig
@@ -17,6 +21,10 @@ type Metric struct {
 	Description string `json:"description"`
 	// Optional labels
 	Labels []string `json:"labels"`
+	// The upper bounds of a histogram's buckets, in increasing order (REQUIRED for histograms)
+	Buckets []float64 `json:"buckets"`
+	// The quantiles a summary reports, between 0 and 1 (REQUIRED for summaries)
+	Quantiles []float64 `json:"quantiles"`
 }
 
 type OperatorConfig struct {
@@ -32,21 +40,54 @@ type OperatorConfig struct {
 	Shards int `json:"shards"`
 	// The authentication token to use (REQUIRED)
 	Auth string `json:"auth"`
+	// Additional named tokens that can use the HTTP API, `auth` is always accepted under the name `default`
+	Tokens []ApiToken `json:"tokens"`
+	// Limits shared by every request to /eval and /entity (optional)
+	RateLimit RateLimit `json:"rateLimit"`
+	// Limits applied to each token's requests to /eval and /entity, unless the token sets its own (optional)
+	TokenRateLimit RateLimit `json:"tokenRateLimit"`
 	// A discord webhook to use for posting cluster related logs
 	Webhook string `json:"webhook"`
 	// A prefix to use for metrics, which a metric would resolve to `prod_servers`.
 	MetricsPrefix string `json:"metricsPrefix"`
 	// An array of metrics that prometheus will scrape
 	Metrics []Metric `json:"metrics"`
-	// If metrics between clusters should be merged together, when this is false, the first clusters metrics will be used
+	// How often stats are requested from clusters in seconds (optional, default 10)
+	StatsInterval int `json:"statsInterval"`
+	// How long to wait for a cluster's stats in milliseconds (optional, default 5000)
+	StatsTimeout int `json:"statsTimeout"`
+	// How old a cluster's stats can be before they're marked as stale in seconds (optional, default 3 times statsInterval)
+	StatsStaleAfter int `json:"statsStaleAfter"`
+	// Name patterns (such as `commands_*`) of metrics clusters can register themselves with a type 12 packet (optional, none by default)
+	DynamicMetrics []string `json:"dynamicMetrics"`
+	// If /metrics should use the OpenMetrics format when prometheus asks for it, which is needed for exemplars (false by default)
+	OpenMetrics bool `json:"openMetrics"`
+	// Where metrics are pushed to with the prometheus remote write protocol (optional)
+	RemoteWrite RemoteWriteConfig `json:"remoteWrite"`
+	// If metrics between clusters should be merged together, when this is false, the metrics of a single cluster (see metricsSource) will be used
 	MergeMetrics bool `json:"mergeMetrics"`
+	// The cluster whose metrics are used when mergeMetrics and clusterLabels are both false (optional, 0 by default)
+	MetricsSource int `json:"metricsSource"`
+	// If every metric should get a cluster label, exposing each cluster's values instead of merging them (false by default)
+	ClusterLabels bool `json:"clusterLabels"`
+	// If every metric should also get a shard_range label when clusterLabels is enabled, such as 0-15 (false by default)
+	ShardRangeLabel bool `json:"shardRangeLabel"`
 	// If the cluster operator should log cluster events to the webhook (as defined above)
 	LogEvents bool `json:"logEvents"`
-	// If prometheus will export default metrics (false by default).
+	// If prometheus will export default metrics (false by default), these are the operator's own metrics, along with go runtime and process metrics.
 	ExportDefaultMetrics bool `json:"exportDefaultMetrics"`
+	// The entity types clusters handle, when empty any entity type is sent to clusters without validation (optional)
+	Entities []EntityType `json:"entities"`
+	// Restrictions on what can be evaluated (optional)
+	EvalPolicy EvalPolicy `json:"evalPolicy"`
+	// Where eval and entity requests are recorded (optional)
+	Audit AuditConfig `json:"audit"`
+	// How the relay treats its clients (optional)
+	Relay RelayConfig `json:"relay"`
 }
 
-func init() {
+// LoadConfig reads and validates config.json from the working directory, exiting when it is missing or invalid.
+func LoadConfig() {
 	cwd, _ := os.Getwd()
 	file, err := os.ReadFile(cwd + "/config.json")
 	if err != nil {
@@ -73,28 +114,164 @@ func init() {
 	if Config.Shards < 1 {
 		logrus.Fatal("Shard count should be greater than 0!")
 	}
+	tokenNames := make(map[string]bool, len(Config.Tokens))
+	for i, token := range Config.Tokens {
+		if token.Name == "" {
+			logrus.Fatalf("tokens[%d].name is a required field!", i)
+		}
+		if token.Token == "" {
+			logrus.Fatalf("tokens[%d].token is a required field!", i)
+		}
+		if token.Name == "default" || token.Token == Config.Auth {
+			logrus.Fatalf("tokens[%d] conflicts with the default auth token!", i)
+		}
+		if tokenNames[token.Name] {
+			logrus.Fatalf("tokens[%d].name %s is already used by another token!", i, token.Name)
+		}
+		tokenNames[token.Name] = true
+	}
+	Config.Tokens = append(Config.Tokens, ApiToken{Name: "default", Token: Config.Auth})
+	entityNames := make(map[string]bool, len(Config.Entities))
+	for i := range Config.Entities {
+		entity := &Config.Entities[i]
+		if entity.Name == "" {
+			logrus.Fatalf("entities[%d].name is a required field!", i)
+		}
+		if entityNames[entity.Name] {
+			logrus.Fatalf("entities[%d].name %s is already used by another entity type!", i, entity.Name)
+		}
+		entityNames[entity.Name] = true
+		if entity.Timeout == 0 {
+			entity.Timeout = 5000
+		}
+		for name, arg := range entity.Args {
+			if err := arg.compile(fmt.Sprintf("entities[%d].args.%s", i, name)); err != nil {
+				logrus.Fatal(err.Error())
+			}
+		}
+	}
+	if err := Config.EvalPolicy.compile(); err != nil {
+		logrus.Fatalf("evalPolicy is invalid: %s", err.Error())
+	}
+	if Config.EvalPolicy.ApprovalTimeout == 0 {
+		Config.EvalPolicy.ApprovalTimeout = 300000
+	}
+	if Config.EvalPolicy.RequireApproval && len(Config.Tokens) < 2 {
+		logrus.Warn("evalPolicy.requireApproval is enabled, but there are no tokens other than the default one to approve evals with!")
+	}
+	if Config.StatsInterval < 1 {
+		Config.StatsInterval = 10
+	}
+	if Config.StatsTimeout < 1 {
+		Config.StatsTimeout = 5000
+	}
+	if Config.StatsStaleAfter < 1 {
+		Config.StatsStaleAfter = Config.StatsInterval * 3
+	}
+	if Config.Relay.BufferSize < 1 {
+		Config.Relay.BufferSize = 256
+	}
+	if Config.Relay.SlowConsumer == "" {
+		Config.Relay.SlowConsumer = SlowConsumerDisconnect
+	}
+	if !(Config.Relay.SlowConsumer == SlowConsumerDropOldest || Config.Relay.SlowConsumer == SlowConsumerDropNew || Config.Relay.SlowConsumer == SlowConsumerDisconnect) {
+		logrus.Fatalf("relay.slowConsumer should be drop_oldest, drop_new or disconnect, received: %s", Config.Relay.SlowConsumer)
+	}
+	if Config.Relay.MaxMessageSize < 1 {
+		Config.Relay.MaxMessageSize = 1048576
+	}
+	if Config.Relay.PingInterval < 1 {
+		Config.Relay.PingInterval = 30
+	}
+	if Config.Relay.PongTimeout < 1 {
+		Config.Relay.PongTimeout = 60
+	}
+	if Config.Relay.PongTimeout <= Config.Relay.PingInterval {
+		logrus.Fatal("relay.pongTimeout should be longer than relay.pingInterval!")
+	}
+	if Config.Relay.Broker == "" {
+		Config.Relay.Broker = RelayBrokerMemory
+	}
+	if Config.Relay.Broker != RelayBrokerMemory && Config.Relay.Broker != RelayBrokerPeer {
+		logrus.Fatalf("relay.broker should be memory or peer, received: %s", Config.Relay.Broker)
+	}
+	for i, peer := range Config.Relay.Peers {
+		if u, err := url.Parse(peer); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+			logrus.Fatalf("relay.peers[%d] should be a ws:// or wss:// URL!", i)
+		}
+	}
+	if len(Config.Relay.Peers) > 0 && Config.Relay.Broker != RelayBrokerPeer {
+		logrus.Warn("relay.peers is set, but relay.broker isn't peer, so the peers won't be used!")
+	}
+	for i, r := range Config.Relay.Retention {
+		if _, err := path.Match(r.Topic, ""); err != nil || r.Topic == "" {
+			logrus.Fatalf("relay.retention[%d].topic should be a topic name or a valid pattern!", i)
+		}
+		if r.Size < 1 {
+			logrus.Fatalf("relay.retention[%d].size should be greater than 0!", i)
+		}
+	}
+	if Config.MetricsSource < 0 || Config.MetricsSource >= Config.Clusters {
+		logrus.Fatalf("metricsSource should be a cluster ID between 0 and %d!", Config.Clusters-1)
+	}
+	if Config.ShardRangeLabel && !Config.ClusterLabels {
+		logrus.Fatal("shardRangeLabel can only be used along with clusterLabels!")
+	}
 	if len(Config.Metrics) > 0 && Config.MetricsPrefix == "" {
 		logrus.Warn("You have set multiple metrics, but no metrics prefix; ignore this warning if you know what you're doing! However, a metric with the name 'ping' can be overwritten by any other cluster operators that run on your server, that prometheus scrapes data from!")
 	}
-	if len(Config.Metrics) > 0 {
-		for i, metric := range Config.Metrics {
-			if metric.Name == "" {
-				logrus.Fatalf("metrics[%d].name is a required field!", i)
-			}
-			if metric.Description == "" {
-				logrus.Fatalf("metrics[%d].description is a required field!", i)
-			}
-			if metric.Type == "" {
-				logrus.Fatalf("metrics[%d].type is a required field!", i)
-			}
-			if !(metric.Type == "gauge" || metric.Type == "counter") {
-				logrus.Fatalf("metrics[%d].type should be gauge or collector, received: %s!", i, metric.Type)
-			}
+	for i, metric := range Config.Metrics {
+		if err := metric.Validate(); err != nil {
+			logrus.Fatalf("metrics[%d].%s!", i, err.Error())
+		}
+	}
+	if Config.RemoteWrite.URL != "" && Config.RemoteWrite.Interval < 1 {
+		Config.RemoteWrite.Interval = 30
+	}
+	if Config.RemoteWrite.URL != "" && Config.RemoteWrite.Timeout < 1 {
+		Config.RemoteWrite.Timeout = 10000
+	}
+	for i, pattern := range Config.DynamicMetrics {
+		if _, err := path.Match(pattern, ""); err != nil {
+			logrus.Fatalf("dynamicMetrics[%d] is not a valid pattern: %s", i, err.Error())
 		}
 	}
 	logrus.Info("Found and loaded config.json!")
 }
 
+// Validate checks that a metric definition can be registered.
+func (m *Metric) Validate() error {
+	if m.Name == "" {
+		return errors.New("name is a required field")
+	}
+	if m.Description == "" {
+		return errors.New("description is a required field")
+	}
+	if m.Type == "" {
+		return errors.New("type is a required field")
+	}
+	if !(m.Type == "gauge" || m.Type == "counter" || m.Type == "histogram" || m.Type == "summary") {
+		return fmt.Errorf("type should be gauge, counter, histogram or summary, received: %s", m.Type)
+	}
+	if m.Type == "histogram" && len(m.Buckets) < 1 {
+		return errors.New("buckets is a required field for histograms")
+	}
+	if m.Type == "summary" && len(m.Quantiles) < 1 {
+		return errors.New("quantiles is a required field for summaries")
+	}
+	for j := 1; j < len(m.Buckets); j++ {
+		if m.Buckets[j] <= m.Buckets[j-1] {
+			return errors.New("buckets should be in increasing order")
+		}
+	}
+	for _, q := range m.Quantiles {
+		if q <= 0 || q >= 1 {
+			return fmt.Errorf("quantiles should be between 0 and 1, received: %v", q)
+		}
+	}
+	return nil
+}
+
 func MetricPrefix(key string) string {
 	return Config.MetricsPrefix + key
 }
@@ -2,8 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/sirupsen/logrus"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -11,18 +14,15 @@ import (
 type EntityHandler struct{}
 
 func (_ *EntityHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		writeJson(w, 405, ApiResponse{Error: true, Message: "Method not allowed"})
+	token := authorize(w, r, "POST")
+	if token == nil {
 		return
 	}
-	if r.Header.Get("Authorization") == "" {
-		writeJson(w, 403, ApiResponse{Error: true, Message: "Unauthorized"})
-		return
-	}
-	if r.Header.Get("Authorization") != Config.Auth {
-		writeJson(w, 403, ApiResponse{Error: true, Message: "Forbidden"})
+	release, ok := limitRequest(w, token)
+	if !ok {
 		return
 	}
+	defer release()
 	if strings.Index(r.Header.Get("Content-Type"), "application/json") == -1 {
 		writeJson(w, 400, ApiResponse{Error: true, Message: "Content-Type either not found, or not application/json!"})
 		return
@@ -41,31 +41,99 @@ func (_ *EntityHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		writeJson(w, 400, ApiResponse{Error: true, Message: "type not specified!"})
 		return
 	}
-	Server.PutEntityChan(body.ID)
-	results := make([]EntityResponse, 0, len(Server.Clients))
-	for _, cluster := range Server.Clients {
+	for _, id := range body.Clusters {
+		if id < 0 || id >= len(Server.Clients) {
+			writeJson(w, 400, ApiResponse{Error: true, Message: fmt.Sprintf("Cluster %d does not exist!", id)})
+			return
+		}
+	}
+	timeout := 5 * time.Second
+	var entity *EntityType
+	if len(Config.Entities) > 0 {
+		entity = findEntityType(body.Type)
+		if entity == nil {
+			writeJson(w, 400, ApiResponse{Error: true, Message: fmt.Sprintf("Unknown entity type %s!", body.Type)})
+			return
+		}
+		if err := entity.ValidateArgs(body.Args); err != nil {
+			writeJson(w, 400, ApiResponse{Error: true, Message: err.Error()})
+			return
+		}
+		timeout = time.Duration(entity.Timeout) * time.Millisecond
+	}
+	entry := NewAuditEntry("entity", body.ID).FromRequest(token, r)
+	entry.Type = body.Type
+	entry.Args = body.Args
+	if entity == nil || entity.CacheTTL < 1 {
+		results := Server.BroadcastEntity(body, timeout, entry)
+		entry.Finish()
+		writeJson(w, 200, ApiResponse{Data: results})
+		return
+	}
+	results, status, age := entityCache.Fetch(entityCacheKey(body), entity, func(status string) []EntityResponse {
+		// Shared requests use their own ID, as the ID of the request that started them could be reused by another one
+		req := *body
+		req.ID = RandomID()
+		fetched := NewAuditEntry("entity", body.ID)
+		fetched.Token, fetched.RemoteAddr, fetched.Type, fetched.Args = entry.Token, entry.RemoteAddr, entry.Type, entry.Args
+		fetched.Cache = status
+		results := Server.BroadcastEntity(&req, timeout, fetched)
+		fetched.Finish()
+		return results
+	})
+	// Misses were already audited when the clusters were asked
+	if status != CacheMiss {
+		entry.Cache = status
+		entry.Finish()
+	}
+	header := "MISS"
+	if status == CacheHit || status == CacheStale {
+		header = strings.ToUpper(status)
+	}
+	w.Header().Set("X-Cache", header)
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	w.Header().Set("Cache-Control", fmt.Sprintf(
+		"max-age=%d, stale-while-revalidate=%d",
+		int(math.Max(0, (time.Duration(entity.CacheTTL)*time.Millisecond-age).Seconds())),
+		entity.StaleTTL/1000,
+	))
+	writeJson(w, 200, ApiResponse{Data: results})
+}
+
+// BroadcastEntity sends an entity request to every ready cluster it targets, waiting up to timeout for each of them to respond.
+func (w *WSServer) BroadcastEntity(req *EntityRequest, timeout time.Duration, entry *AuditEntry) []EntityResponse {
+	w.PutEntityChan(req.ID)
+	results := make([]EntityResponse, 0, len(w.Clients))
+	for _, cluster := range w.Clients {
+		if !req.Targets(cluster.ID) {
+			continue
+		}
 		if cluster.State == ClusterWaiting || cluster.State == ClusterConnecting {
 			results = append(results, EntityResponse{Error: "cluster unhealthy"})
 			continue
 		}
-		cluster.Write(Entity, body)
+		entry.Targets = append(entry.Targets, cluster.ID)
+		start := time.Now()
+		cluster.Write(Entity, req)
 		select {
-		case resp := <-Server.GetEntityChan(body.ID):
+		case resp := <-w.GetEntityChan(req.ID):
 			{
 				results = append(results, EntityResponse{
 					ID:    "",
 					Error: resp.Error,
 					Data:  resp.Data,
 				})
+				entry.Record(cluster.ID, resp.Error, start)
 				break
 			}
-		case <-time.After(5 * time.Second):
+		case <-time.After(timeout):
 			{
 				results = append(results, EntityResponse{Error: "timed out"})
+				entry.RecordTimeout(cluster.ID, "timed out", start)
 				break
 			}
 		}
 	}
-	Server.DeleteEntityChan(body.ID)
-	writeJson(w, 200, ApiResponse{Data: results})
+	w.DeleteEntityChan(req.ID)
+	return results
 }
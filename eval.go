@@ -17,18 +17,15 @@ func writeJson(w http.ResponseWriter, status int, body interface{}) {
 }
 
 func (_ *EvalHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		writeJson(w, 405, ApiResponse{Error: true, Message: "Method not allowed"})
+	token := authorize(w, r, "POST")
+	if token == nil {
 		return
 	}
-	if r.Header.Get("Authorization") == "" {
-		writeJson(w, 403, ApiResponse{Error: true, Message: "Unauthorized"})
-		return
-	}
-	if r.Header.Get("Authorization") != Config.Auth {
-		writeJson(w, 403, ApiResponse{Error: true, Message: "Forbidden"})
+	release, ok := limitRequest(w, token)
+	if !ok {
 		return
 	}
+	defer release()
 	if strings.Index(r.Header.Get("Content-Type"), "application/json") == -1 {
 		writeJson(w, 400, ApiResponse{Error: true, Message: "Content-Type either not found, or not application/json!"})
 		return
@@ -51,9 +48,89 @@ func (_ *EvalHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		writeJson(w, 400, ApiResponse{Error: true, Message: "Timeout not specified!"})
 		return
 	}
-	Server.PutEvalChan(body.ID)
-	results := make([]EvalRes, 0, len(Server.Clients))
-	for _, cluster := range Server.Clients {
+	entry := NewAuditEntry("eval", body.ID).FromRequest(token, r)
+	entry.Code = body.Code
+	if err := Config.EvalPolicy.Check(body.Code); err != nil {
+		entry.Error = err.Error()
+		entry.Finish()
+		writeJson(w, 403, ApiResponse{Error: true, Message: err.Error()})
+		return
+	}
+	if Config.EvalPolicy.RequireApproval {
+		if !PutPendingEval(&PendingEval{Request: *body, Token: token.Name, Submitted: time.Now(), entry: entry}) {
+			writeJson(w, 409, ApiResponse{Error: true, Message: "An eval with this ID is already waiting for approval!"})
+			return
+		}
+		logrus.Infof("Eval %s from %s is waiting for approval", body.ID, token.Name)
+		writeJson(w, 202, ApiResponse{Message: "Eval is waiting for approval!", Data: body.ID})
+		return
+	}
+	results := Server.BroadcastEval(body, time.Duration(body.Timeout)*time.Millisecond, entry)
+	entry.Finish()
+	writeJson(w, 200, ApiResponse{Data: results})
+}
+
+type EvalApproval struct {
+	ID string `json:"id"`
+}
+
+type EvalApprovalHandler struct{}
+
+func (_ *EvalApprovalHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := authorize(w, r, "POST")
+	if token == nil {
+		return
+	}
+	release, ok := limitRequest(w, token)
+	if !ok {
+		return
+	}
+	defer release()
+	if strings.Index(r.Header.Get("Content-Type"), "application/json") == -1 {
+		writeJson(w, 400, ApiResponse{Error: true, Message: "Content-Type either not found, or not application/json!"})
+		return
+	}
+	body := &EvalApproval{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logrus.Errorf("Failed to decode JSON body for eval approval: %s", err.Error())
+		writeJson(w, 500, ApiResponse{Error: true, Message: "Unable to decode JSON body!"})
+		return
+	}
+	if body.ID == "" {
+		writeJson(w, 400, ApiResponse{Error: true, Message: "Eval ID not specified!"})
+		return
+	}
+	pending := TakePendingEval(body.ID)
+	if pending == nil {
+		writeJson(w, 404, ApiResponse{Error: true, Message: "No eval with this ID is waiting for approval!"})
+		return
+	}
+	if pending.Token == token.Name {
+		PutPendingEval(pending)
+		writeJson(w, 403, ApiResponse{Error: true, Message: "An eval can't be approved by the token that submitted it!"})
+		return
+	}
+	logrus.Infof("Eval %s from %s was approved by %s", body.ID, pending.Token, token.Name)
+	pending.entry.ApprovedBy = token.Name
+	results := Server.BroadcastEval(&pending.Request, time.Duration(pending.Request.Timeout)*time.Millisecond, pending.entry)
+	pending.entry.Finish()
+	writeJson(w, 200, ApiResponse{Data: results})
+}
+
+type PendingEvalHandler struct{}
+
+func (_ *PendingEvalHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if authorize(w, r, "GET") == nil {
+		return
+	}
+	writeJson(w, 200, ApiResponse{Data: PendingEvals()})
+}
+
+// BroadcastEval sends an eval to every ready cluster, waiting up to timeout for each of them to respond.
+func (w *WSServer) BroadcastEval(req *BroadcastEvalRequest, timeout time.Duration, entry *AuditEntry) []EvalRes {
+	w.PutEvalChan(req.ID)
+	results := make([]EvalRes, 0, len(w.Clients))
+	for _, cluster := range w.Clients {
 		if cluster.State == ClusterConnecting {
 			results = append(results, EvalRes{Error: "Cluster is connecting!"})
 			continue
@@ -62,27 +139,32 @@ func (_ *EvalHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			results = append(results, EvalRes{Error: "Cluster is not ready!"})
 			continue
 		}
+		entry.Targets = append(entry.Targets, cluster.ID)
+		start := time.Now()
 		cluster.Write(Eval, BroadcastEvalRequest{
-			ID:      body.ID,
-			Code:    body.Code,
+			ID:      req.ID,
+			Code:    req.Code,
 			Timeout: -1,
 		})
 		select {
-		case resp := <-Server.GetEvalChan(body.ID):
+		case resp := <-w.GetEvalChan(req.ID):
 			{
 				results = append(results, EvalRes{
 					ID:    "",
 					Res:   resp.Res,
 					Error: resp.Error,
 				})
+				entry.Record(cluster.ID, resp.Error, start)
 				break
 			}
-		case <-time.After(time.Duration(body.Timeout) * time.Millisecond):
+		case <-time.After(timeout):
 			{
 				results = append(results, EvalRes{Error: "Response timed out"})
+				entry.RecordTimeout(cluster.ID, "Response timed out", start)
 				break
 			}
 		}
 	}
-	writeJson(w, 200, ApiResponse{Data: results})
+	w.DeleteEvalChan(req.ID)
+	return results
 }
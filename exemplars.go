@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// exemplarMetric attaches the exemplars clusters reported to a constant metric, they're only exposed in the OpenMetrics format.
+type exemplarMetric struct {
+	prometheus.Metric
+	exemplar  *dto.Exemplar
+	exemplars map[float64]*dto.Exemplar
+}
+
+func (m *exemplarMetric) Write(pb *dto.Metric) error {
+	if err := m.Metric.Write(pb); err != nil {
+		return err
+	}
+	if pb.Counter != nil && m.exemplar != nil {
+		pb.Counter.Exemplar = m.exemplar
+	}
+	if pb.Histogram != nil {
+		for _, bucket := range pb.Histogram.Bucket {
+			if e, ok := m.exemplars[bucket.GetUpperBound()]; ok {
+				bucket.Exemplar = e
+			}
+		}
+	}
+	return nil
+}
+
+// withExemplars wraps a metric when a sample has exemplars.
+func withExemplars(m prometheus.Metric, s *sample) prometheus.Metric {
+	if s.exemplar == nil && len(s.exemplars) < 1 {
+		return m
+	}
+	return &exemplarMetric{Metric: m, exemplar: s.exemplar, exemplars: s.exemplars}
+}
+
+// parseExemplar reads an exemplar, which clusters report like so:
+// {"labels": {"trace_id": "abc"}, "value": 0.42, "timestamp": 1630000000.5}
+// The timestamp is in seconds, and is optional.
+func parseExemplar(v interface{}) (*dto.Exemplar, error) {
+	data, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an exemplar to be an object, got %s instead", reflect.TypeOf(v))
+	}
+	value, ok := data["value"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("expected the value of an exemplar to be a number, got %s instead", reflect.TypeOf(data["value"]))
+	}
+	e := &dto.Exemplar{Value: proto.Float64(value)}
+	ts := time.Now()
+	if seconds, ok := data["timestamp"].(float64); ok {
+		whole, frac := math.Modf(seconds)
+		ts = time.Unix(int64(whole), int64(frac*1e9))
+	}
+	e.Timestamp = timestamppb.New(ts)
+	labels, _ := data["labels"].(map[string]interface{})
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	runes := 0
+	for _, name := range names {
+		value, ok := labels[name].(string)
+		if !ok {
+			return nil, fmt.Errorf("expected exemplar label %s to be a string", name)
+		}
+		runes += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+		e.Label = append(e.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	if runes > prometheus.ExemplarMaxRunes {
+		return nil, fmt.Errorf("exemplar labels have %d runes, exceeding the limit of %d", runes, prometheus.ExemplarMaxRunes)
+	}
+	return e, nil
+}
+
+// parseBucketExemplars reads the exemplars of a histogram, keyed by the upper bound of their bucket.
+func parseBucketExemplars(v interface{}) (map[float64]*dto.Exemplar, error) {
+	data, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected exemplars to be an object, got %s instead", reflect.TypeOf(v))
+	}
+	exemplars := make(map[float64]*dto.Exemplar, len(data))
+	for key, child := range data {
+		bound, err := strconv.ParseFloat(key, 64)
+		if err != nil {
+			return nil, fmt.Errorf("exemplar bucket %s is not a number", key)
+		}
+		e, err := parseExemplar(child)
+		if err != nil {
+			return nil, fmt.Errorf("bucket %s: %s", key, err.Error())
+		}
+		exemplars[bound] = e
+	}
+	return exemplars, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"testing"
+	"time"
+)
+
+// gather collects the metrics of a handler the way the registry does when it's scraped.
+func gather(t *testing.T, h *MetricsHandler, metrics ...string) map[string]*dto.Metric {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	for _, name := range metrics {
+		m := h.definitions[name]
+		reg.MustRegister(&Collector{metric: name, kind: m.Type, desc: prometheus.NewDesc(name, name, nil, nil), h: h})
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := make(map[string]*dto.Metric, len(families))
+	for _, family := range families {
+		if len(family.Metric) != 1 {
+			t.Fatalf("expected a single %s metric, got %d", family.GetName(), len(family.Metric))
+		}
+		gathered[family.GetName()] = family.Metric[0]
+	}
+	return gathered
+}
+
+func TestExemplarsAreCollected(t *testing.T) {
+	h, c := newTestMetrics(t,
+		Metric{Name: "commands", Type: "counter"},
+		Metric{Name: "latency", Type: "histogram", Buckets: []float64{0.1, 1}},
+	)
+	h.Push(c, map[string]interface{}{
+		"commands": map[string]interface{}{
+			"value":    3.0,
+			"exemplar": map[string]interface{}{"labels": map[string]interface{}{"trace_id": "abc"}, "value": 1.0, "timestamp": 1630000000.5},
+		},
+		"latency": map[string]interface{}{
+			"buckets":   map[string]interface{}{"0.1": 1.0, "1": 2.0, "+Inf": 2.0},
+			"sum":       0.6,
+			"count":     2.0,
+			"exemplars": map[string]interface{}{"1": map[string]interface{}{"labels": map[string]interface{}{"trace_id": "def"}, "value": 0.5}},
+		},
+	})
+	metrics := gather(t, h, "commands", "latency")
+
+	e := metrics["commands"].GetCounter().GetExemplar()
+	if e == nil {
+		t.Fatal("the counter has no exemplar")
+	}
+	if e.GetValue() != 1 || len(e.Label) != 1 || e.Label[0].GetName() != "trace_id" || e.Label[0].GetValue() != "abc" {
+		t.Errorf("counter exemplar = %v", e)
+	}
+	if ts := e.GetTimestamp().AsTime(); !ts.Equal(time.Unix(1630000000, 5e8)) {
+		t.Errorf("counter exemplar timestamp = %v", ts)
+	}
+
+	for _, bucket := range metrics["latency"].GetHistogram().GetBucket() {
+		e := bucket.GetExemplar()
+		if bucket.GetUpperBound() != 1 {
+			if e != nil {
+				t.Errorf("bucket %v has an exemplar", bucket.GetUpperBound())
+			}
+			continue
+		}
+		if e == nil || e.GetValue() != 0.5 || e.Label[0].GetValue() != "def" {
+			t.Errorf("bucket 1 exemplar = %v", e)
+		}
+		if e.GetTimestamp() == nil {
+			t.Error("exemplars without a timestamp should get the time they were received")
+		}
+	}
+}
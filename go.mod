@@ -3,7 +3,11 @@ module cluster-operator
 go 1.16
 
 require (
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/golang/snappy v0.0.4
 	github.com/gorilla/websocket v1.4.2
 	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/sirupsen/logrus v1.8.1
+	google.golang.org/protobuf v1.27.1
 )
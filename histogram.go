@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	dto "github.com/prometheus/client_model/go"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// parseDistribution reads the value of a histogram or summary metric, which clusters report like so:
+// {"buckets": {"0.1": 3, "+Inf": 5}, "sum": 1.5, "count": 5} for histograms, where bucket counts are cumulative.
+// Histograms can also have "exemplars", keyed by the bucket they belong to like buckets are.
+// {"quantiles": {"0.5": 0.2, "0.99": 0.9}, "sum": 1.5, "count": 5} for summaries.
+func parseDistribution(m *Metric, child interface{}) (sample, error) {
+	s := sample{}
+	data, ok := child.(map[string]interface{})
+	if !ok {
+		return s, fmt.Errorf("expected an object with sum and count, got %s instead", reflect.TypeOf(child))
+	}
+	count, ok := data["count"].(float64)
+	if !ok {
+		return s, fmt.Errorf("expected count to be a number, got %s instead", reflect.TypeOf(data["count"]))
+	}
+	sum, ok := data["sum"].(float64)
+	if !ok {
+		return s, fmt.Errorf("expected sum to be a number, got %s instead", reflect.TypeOf(data["sum"]))
+	}
+	s.count = uint64(count)
+	s.sum = sum
+	if m.Type == "histogram" {
+		buckets, ok := data["buckets"].(map[string]interface{})
+		if !ok {
+			return s, fmt.Errorf("expected buckets to be an object, got %s instead", reflect.TypeOf(data["buckets"]))
+		}
+		s.buckets = make(map[float64]uint64, len(m.Buckets))
+		for _, bound := range m.Buckets {
+			v, ok := buckets[strconv.FormatFloat(bound, 'f', -1, 64)].(float64)
+			if !ok {
+				return s, fmt.Errorf("expected bucket %v to be a number", bound)
+			}
+			s.buckets[bound] = uint64(v)
+		}
+		for key := range buckets {
+			bound, err := strconv.ParseFloat(key, 64)
+			if err != nil {
+				return s, fmt.Errorf("bucket %s is not a number", key)
+			}
+			if _, ok := s.buckets[bound]; !ok && !math.IsInf(bound, 1) {
+				return s, fmt.Errorf("bucket %s is not one of the configured buckets", key)
+			}
+		}
+		if exemplars, ok := data["exemplars"]; ok {
+			var err error
+			if s.exemplars, err = parseBucketExemplars(exemplars); err != nil {
+				return s, fmt.Errorf("exemplars: %s", err.Error())
+			}
+		}
+		return s, nil
+	}
+	quantiles, ok := data["quantiles"].(map[string]interface{})
+	if !ok {
+		return s, fmt.Errorf("expected quantiles to be an object, got %s instead", reflect.TypeOf(data["quantiles"]))
+	}
+	s.quantiles = make(map[float64]float64, len(m.Quantiles))
+	for _, q := range m.Quantiles {
+		v, ok := quantiles[strconv.FormatFloat(q, 'f', -1, 64)].(float64)
+		if !ok {
+			return s, fmt.Errorf("expected quantile %v to be a number", q)
+		}
+		s.quantiles[q] = v
+	}
+	return s, nil
+}
+
+// since returns how much a cumulative histogram or summary grew since last.
+// The returned sample has no quantiles, as they can't be subtracted.
+func (s sample) since(last sample) sample {
+	delta := sample{labels: s.labels, count: s.count - last.count, sum: s.sum - last.sum, exemplar: s.exemplar, exemplars: s.exemplars}
+	if s.buckets != nil {
+		delta.buckets = make(map[float64]uint64, len(s.buckets))
+		for bound, v := range s.buckets {
+			delta.buckets[bound] = v - last.buckets[bound]
+		}
+	}
+	return delta
+}
+
+// reset reports if a cumulative histogram or summary went down, which means the cluster restarted.
+func (s sample) reset(last sample) bool {
+	if s.count < last.count {
+		return true
+	}
+	for bound, v := range s.buckets {
+		if v < last.buckets[bound] {
+			return true
+		}
+	}
+	return false
+}
+
+// addDistribution adds the count, sum and buckets of delta to s, keeping the newest exemplars.
+func (s *sample) addDistribution(delta sample) {
+	s.count += delta.count
+	s.sum += delta.sum
+	if delta.exemplar != nil {
+		s.exemplar = delta.exemplar
+	}
+	if delta.exemplars != nil && s.exemplars == nil {
+		s.exemplars = make(map[float64]*dto.Exemplar, len(delta.exemplars))
+	}
+	for bound, e := range delta.exemplars {
+		s.exemplars[bound] = e
+	}
+	if delta.buckets != nil && s.buckets == nil {
+		s.buckets = make(map[float64]uint64, len(delta.buckets))
+	}
+	for bound, v := range delta.buckets {
+		s.buckets[bound] += v
+	}
+}
+
+// mergeQuantiles averages the quantiles of summaries from several clusters, weighted by their counts.
+// This is only an approximation, quantiles can't be merged exactly.
+func mergeQuantiles(samples []sample) map[float64]float64 {
+	merged := make(map[float64]float64)
+	total := uint64(0)
+	for _, s := range samples {
+		total += s.count
+	}
+	for _, s := range samples {
+		for q, v := range s.quantiles {
+			if total == 0 {
+				merged[q] += v / float64(len(samples))
+				continue
+			}
+			merged[q] += v * float64(s.count) / float64(total)
+		}
+	}
+	return merged
+}
@@ -113,9 +113,14 @@ func (log *Logger) PostLog(c *Cluster, color int, event string) {
 	}
 	res, err := log.client.Do(req)
 	if err != nil {
+		operatorMetrics.WebhookFailed("log")
 		logrus.Errorf("PostLog failed to get a response: %s", err.Error())
 		return
 	}
+	_ = res.Body.Close()
+	if res.StatusCode >= 300 {
+		operatorMetrics.WebhookFailed("log")
+	}
 	logrus.Debugf("Got status %s from Discord in %s, when firing event %s!", res.Status, time.Now().Sub(s).String(), event)
 }
 
@@ -134,8 +139,13 @@ func (log *Logger) PostOperatorLog(color int, event string) {
 	}
 	res, err := log.client.Do(req)
 	if err != nil {
+		operatorMetrics.WebhookFailed("log")
 		logrus.Errorf("PostOperatorLog failed to get a response: %s", err.Error())
 		return
 	}
+	_ = res.Body.Close()
+	if res.StatusCode >= 300 {
+		operatorMetrics.WebhookFailed("log")
+	}
 	logrus.Debugf("Got status %s from Discord in %s, when posting operator log!", res.Status, time.Now().Sub(s).String())
 }
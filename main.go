@@ -18,7 +18,11 @@ func init() {
 }
 
 func main() {
+	LoadConfig()
 	NewLogger()
+	SetupLimits()
+	NewAuditor()
+	NewOperatorMetrics()
 	Server = &WSServer{
 		Clients:        []*Cluster{},
 		Upgrader:       websocket.Upgrader{},
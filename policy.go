@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"regexp"
+	"sync"
+	"time"
+)
+
+type EvalPolicy struct {
+	// Rejects every eval when true
+	Disabled bool `json:"disabled"`
+	// Regular expressions that code must match at least one of, use ^ to match a prefix (optional)
+	Allow []string `json:"allow"`
+	// Regular expressions that code must not match (optional)
+	Deny []string `json:"deny"`
+	// The longest code that can be evaluated (optional, 0 means unlimited)
+	MaxCodeLength int `json:"maxCodeLength"`
+	// If evals made through /eval should wait for another token to approve them through /eval/approve
+	RequireApproval bool `json:"requireApproval"`
+	// How long an eval waits to be approved in milliseconds (optional, default 300000)
+	ApprovalTimeout int `json:"approvalTimeout"`
+	allow           []*regexp.Regexp
+	deny            []*regexp.Regexp
+}
+
+type PendingEval struct {
+	Request   BroadcastEvalRequest `json:"request"`
+	Token     string               `json:"token"`
+	Submitted time.Time            `json:"submitted"`
+	entry     *AuditEntry
+	// Expires the eval once approvalTimeout has passed
+	timer *time.Timer
+}
+
+var (
+	pendingEvals = make(map[string]*PendingEval)
+	pendingMutex = &sync.Mutex{}
+)
+
+// compile parses the allow and deny patterns, this is called when the config is loaded.
+func (p *EvalPolicy) compile() error {
+	for _, pattern := range p.Allow {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("allow pattern %s is invalid: %s", pattern, err.Error())
+		}
+		p.allow = append(p.allow, re)
+	}
+	for _, pattern := range p.Deny {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("deny pattern %s is invalid: %s", pattern, err.Error())
+		}
+		p.deny = append(p.deny, re)
+	}
+	return nil
+}
+
+// Check returns why code cannot be evaluated, or nil if it can.
+func (p *EvalPolicy) Check(code string) error {
+	if p.Disabled {
+		return errors.New("Eval is disabled!")
+	}
+	if p.MaxCodeLength > 0 && len(code) > p.MaxCodeLength {
+		return fmt.Errorf("Code is longer than %d characters!", p.MaxCodeLength)
+	}
+	for _, re := range p.deny {
+		if re.MatchString(code) {
+			return errors.New("Code is not allowed!")
+		}
+	}
+	if len(p.allow) < 1 {
+		return nil
+	}
+	for _, re := range p.allow {
+		if re.MatchString(code) {
+			return nil
+		}
+	}
+	return errors.New("Code is not allowed!")
+}
+
+func (p *EvalPolicy) expired(pending *PendingEval) bool {
+	return time.Since(pending.Submitted) > time.Duration(p.ApprovalTimeout)*time.Millisecond
+}
+
+// PutPendingEval stores an eval until it's approved, returning false if an eval with the same ID is already pending.
+func PutPendingEval(pending *PendingEval) bool {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	if _, ok := pendingEvals[pending.Request.ID]; ok {
+		return false
+	}
+	pendingEvals[pending.Request.ID] = pending
+	expires := pending.Submitted.Add(time.Duration(Config.EvalPolicy.ApprovalTimeout) * time.Millisecond)
+	pending.timer = time.AfterFunc(time.Until(expires), func() {
+		expirePendingEval(pending)
+	})
+	return true
+}
+
+// TakePendingEval removes and returns a pending eval, unless it doesn't exist or has expired.
+func TakePendingEval(id string) *PendingEval {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	pending, ok := pendingEvals[id]
+	// An eval that expired is left for its timer, which is about to record it
+	if !ok || Config.EvalPolicy.expired(pending) {
+		return nil
+	}
+	pending.timer.Stop()
+	delete(pendingEvals, id)
+	return pending
+}
+
+// expirePendingEval discards an eval that wasn't approved in time, recording it as rejected.
+func expirePendingEval(pending *PendingEval) {
+	pendingMutex.Lock()
+	current, ok := pendingEvals[pending.Request.ID]
+	if !ok || current != pending {
+		pendingMutex.Unlock()
+		return
+	}
+	delete(pendingEvals, pending.Request.ID)
+	pendingMutex.Unlock()
+	logrus.Infof("Eval %s from %s was not approved in time", pending.Request.ID, pending.Token)
+	pending.entry.Error = "Approval timed out"
+	pending.entry.Finish()
+}
+
+// PendingEvals lists every eval that is waiting to be approved.
+func PendingEvals() []*PendingEval {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	list := make([]*PendingEval, 0, len(pendingEvals))
+	for _, p := range pendingEvals {
+		if !Config.EvalPolicy.expired(p) {
+			list = append(list, p)
+		}
+	}
+	return list
+}
@@ -1,42 +1,125 @@
 package main
 
 import (
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"path"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 )
 
+// Collector exposes the values clusters have reported for a metric as constant metrics, every time prometheus scrapes the operator.
 type Collector struct {
-	metric   string
-	original prometheus.Collector
+	metric string
+	kind   string
+	desc   *prometheus.Desc
+	h      *MetricsHandler
 }
 
 type MetricsHandler struct {
-	metrics      []Collector
+	definitions  map[string]*Metric
 	clusterCount prometheus.Gauge
 	shardCount   prometheus.Gauge
+	statsAge     *prometheus.GaugeVec
+	statsStale   *prometheus.GaugeVec
+	clusterUp    *prometheus.GaugeVec
+	statsErrors  *prometheus.CounterVec
+	mutex        *sync.RWMutex
+	snapshots    map[int]*clusterSnapshot
+	values       map[string]map[string]*sample
+	counters     *counterTracker
+	// The sum of every increment each cluster streamed, by cluster ID, which is added to the stats it reported
+	increments map[int]map[string]interface{}
+}
+
+// A single value of a metric, labels are in the same order as the metric's labels.
+// Histograms and summaries use count and sum, along with their buckets or quantiles instead of value.
+type sample struct {
+	labels    []string
+	value     float64
+	count     uint64
+	sum       float64
+	buckets   map[float64]uint64
+	quantiles map[float64]float64
+	// The latest exemplar of a counter, and of each bucket of a histogram
+	exemplar  *dto.Exemplar
+	exemplars map[float64]*dto.Exemplar
+}
+
+// counterTracker turns the cumulative counters, histograms and summaries clusters report into totals that never go down, even when a cluster restarts.
+type counterTracker struct {
+	last   map[string]sample
+	totals map[string]map[string]*sample
 }
 
 var (
+	Metrics           *MetricsHandler
 	registry          = prometheus.NewRegistry()
-	prometheusHandler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	prometheusHandler http.Handler
 )
 
-func findMetricByName(name string) *Metric {
-	for _, metric := range Config.Metrics {
-		if metric.Name == name {
-			return &metric
+// findMetric returns the definition of a metric from the config, or one that a cluster registered, the mutex must be held.
+func (h *MetricsHandler) findMetric(name string) *Metric {
+	return h.definitions[name]
+}
+
+func labelKey(labels []string) string {
+	return strings.Join(labels, "\xff")
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.h.mutex.RLock()
+	defer c.h.mutex.RUnlock()
+	for _, s := range c.h.values[c.metric] {
+		var m prometheus.Metric
+		var err error
+		switch c.kind {
+		case "gauge":
+			m, err = prometheus.NewConstMetric(c.desc, prometheus.GaugeValue, s.value, s.labels...)
+		case "counter":
+			m, err = prometheus.NewConstMetric(c.desc, prometheus.CounterValue, s.value, s.labels...)
+			if err == nil {
+				m = withExemplars(m, s)
+			}
+		case "histogram":
+			m, err = prometheus.NewConstHistogram(c.desc, s.count, s.sum, s.buckets, s.labels...)
+			if err == nil {
+				m = withExemplars(m, s)
+			}
+		case "summary":
+			m, err = prometheus.NewConstSummary(c.desc, s.count, s.sum, s.quantiles, s.labels...)
+		}
+		if err != nil {
+			logrus.Errorf("Failed to collect metric %s: %s", c.metric, err.Error())
+			continue
 		}
+		ch <- m
 	}
-	return nil
 }
 
 // Setup registers all metrics that the user has defined in their config.json
 // This also exposes 2 default metrics (unless disabled), cluster_count and shard_count
 func (h *MetricsHandler) Setup() {
+	h.mutex = &sync.RWMutex{}
+	h.definitions = make(map[string]*Metric)
+	h.snapshots = make(map[int]*clusterSnapshot)
+	h.increments = make(map[int]map[string]interface{})
+	h.values = make(map[string]map[string]*sample)
+	prometheusHandler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: Config.OpenMetrics})
+	h.counters = &counterTracker{
+		last:   make(map[string]sample),
+		totals: make(map[string]map[string]*sample),
+	}
 	h.clusterCount = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: MetricPrefix("cluster_count"),
 		Help: "Total clusters!",
@@ -45,160 +128,356 @@ func (h *MetricsHandler) Setup() {
 		Name: MetricPrefix("shard_count"),
 		Help: "Total shards!",
 	})
-	registry.MustRegister(h.clusterCount, h.shardCount)
+	h.statsAge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricPrefix("cluster_stats_age_seconds"),
+		Help: "How long ago each cluster last reported its stats!",
+	}, []string{"cluster"})
+	h.statsStale = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricPrefix("cluster_stats_stale"),
+		Help: "If each cluster's stats are older than statsStaleAfter!",
+	}, []string{"cluster"})
+	h.clusterUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricPrefix("cluster_up"),
+		Help: "If each cluster is ready and its stats aren't stale!",
+	}, []string{"cluster"})
+	h.statsErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: MetricPrefix("stats_errors_total"),
+		Help: "Metric values clusters reported in a shape that doesn't match the metric!",
+	}, []string{"metric", "cluster"})
+	registry.MustRegister(h.clusterCount, h.shardCount, h.statsAge, h.statsStale, h.clusterUp, h.statsErrors)
+	if Config.ExportDefaultMetrics {
+		operatorMetrics.register()
+	}
 	for _, metric := range Config.Metrics {
-		var collector prometheus.Collector
-		if metric.Type == "gauge" && len(metric.Labels) > 0 {
-			collector = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-				Name: MetricPrefix(metric.Name),
-				Help: metric.Description,
-			}, metric.Labels)
-		} else if metric.Type == "gauge" && len(metric.Labels) < 1 {
-			collector = prometheus.NewGauge(prometheus.GaugeOpts{
-				Name: MetricPrefix(metric.Name),
-				Help: metric.Description,
-			})
-		} else if metric.Type == "counter" && len(metric.Labels) > 0 {
-			collector = prometheus.NewCounterVec(prometheus.CounterOpts{
-				Name: MetricPrefix(metric.Name),
-				Help: metric.Description,
-			}, metric.Labels)
-		} else if metric.Type == "counter" && len(metric.Labels) < 1 {
-			collector = prometheus.NewCounter(prometheus.CounterOpts{
-				Name: MetricPrefix(metric.Name),
-				Help: metric.Description,
-			})
-		}
-		h.metrics = append(h.metrics, Collector{
-			metric:   metric.Name,
-			original: collector,
-		})
-		if err := registry.Register(collector); err == nil {
+		metric := metric
+		if err := h.register(&metric); err == nil {
 			logrus.Infof("Picked up and registered metric %s as type %s", metric.Name, metric.Type)
 		} else {
 			logrus.Errorf("Failed to register metric %s: %s", metric.Name, err.Error())
 		}
 	}
+	go h.collectLoop()
+	if Config.RemoteWrite.URL != "" {
+		go h.remoteWriteLoop()
+	}
 }
 
-// This function will merge all cluster metrics into a single map of objects.
-// Just a reminder that, anything as a nested object will be treated as a LABELED metric, and expects it's children stats to also be maps with a number as it's value.
-// Cluster is a special label, representing the current cluster.
-func (h *MetricsHandler) mergeMetrics(metrics []map[string]interface{}) map[string]interface{} {
-	merged := make(map[string]interface{})
-	for i, metric := range metrics {
-		for key, child := range metric {
-			m := findMetricByName(key)
-			if m == nil {
-				logrus.Warnf("Cluster %d has an unknown metric field %s!", i, key)
-				continue
+// register adds a collector for a metric to the registry.
+// The mutex can't be held, as the registry might be collecting metrics, which needs the mutex too.
+func (h *MetricsHandler) register(metric *Metric) error {
+	collector := &Collector{
+		metric: metric.Name,
+		kind:   metric.Type,
+		desc:   prometheus.NewDesc(MetricPrefix(metric.Name), metric.Description, exposedLabels(metric), nil),
+		h:      h,
+	}
+	if err := registry.Register(collector); err != nil {
+		return err
+	}
+	h.mutex.Lock()
+	h.definitions[metric.Name] = metric
+	h.mutex.Unlock()
+	return nil
+}
+
+// RegisterDynamic registers the metrics a cluster advertised, as long as they match dynamicMetrics and don't conflict with a metric that already exists.
+// Metrics that are exactly the same as an existing one are ignored, as every cluster is expected to advertise them.
+func (h *MetricsHandler) RegisterDynamic(c *Cluster, metrics []Metric) {
+	for _, metric := range metrics {
+		metric := metric
+		if err := metric.Validate(); err != nil {
+			logrus.Warnf("Cluster %d advertised an invalid metric %s: %s", c.ID, metric.Name, err.Error())
+			continue
+		}
+		h.mutex.RLock()
+		existing := h.findMetric(metric.Name)
+		h.mutex.RUnlock()
+		if existing != nil {
+			if !sameMetric(existing, &metric) {
+				logrus.Warnf("Cluster %d advertised metric %s, which conflicts with the existing definition!", c.ID, metric.Name)
 			}
-			if f, ok := child.(float64); ok {
-				if len(m.Labels) > 0 && m.Labels[0] == "cluster" {
-					if _, ok := merged[key]; ok {
-						merged[key].(map[string]interface{})[strconv.Itoa(i)] = f
-					} else {
-						merged[key] = map[string]interface{}{strconv.Itoa(i): f}
-					}
-				} else {
-					if v, ok := merged[key]; ok {
-						merged[key] = v.(float64) + f
-					} else {
-						merged[key] = f
-					}
-				}
+			continue
+		}
+		if !dynamicMetricAllowed(metric.Name) {
+			logrus.Warnf("Cluster %d advertised metric %s, which is not allowed by dynamicMetrics!", c.ID, metric.Name)
+			continue
+		}
+		if err := h.register(&metric); err != nil {
+			// Another cluster registered the same metric at the same time
+			if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+				continue
 			}
-			if m, ok := child.(map[string]interface{}); ok {
-				for k, v := range m {
-					if f, ok := v.(float64); ok {
-						if mergedMap, ok := merged[key].(map[string]interface{}); ok {
-							if v1, ok := mergedMap[k]; ok {
-								mergedMap[k] = v1.(float64) + f
-							} else {
-								mergedMap[k] = f
-							}
-							merged[key] = mergedMap
-						} else {
-							merged[key] = map[string]interface{}{
-								k: f,
-							}
-						}
-					} else {
-						logrus.Errorf("Expected key %s to be an integer, got %s instead!", k, reflect.TypeOf(v).Name())
-					}
-				}
+			logrus.Warnf("Cluster %d advertised metric %s, which could not be registered: %s", c.ID, metric.Name, err.Error())
+			continue
+		}
+		logrus.Infof("Cluster %d registered metric %s as type %s", c.ID, metric.Name, metric.Type)
+	}
+}
+
+func sameMetric(a, b *Metric) bool {
+	return a.Type == b.Type &&
+		reflect.DeepEqual(a.Labels, b.Labels) &&
+		reflect.DeepEqual(a.Buckets, b.Buckets) &&
+		reflect.DeepEqual(a.Quantiles, b.Quantiles)
+}
+
+func dynamicMetricAllowed(name string) bool {
+	for _, pattern := range Config.DynamicMetrics {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseValue reads a single value of a metric, which is a number for gauges and counters.
+// Counters can also be reported along with an exemplar, as {"value": 1, "exemplar": {...}}
+func parseValue(m *Metric, v interface{}) (sample, error) {
+	if m.Type == "histogram" || m.Type == "summary" {
+		return parseDistribution(m, v)
+	}
+	if data, ok := v.(map[string]interface{}); ok && m.Type == "counter" {
+		s, err := parseValue(m, data["value"])
+		if err != nil {
+			return s, err
+		}
+		if e, ok := data["exemplar"]; ok {
+			if s.exemplar, err = parseExemplar(e); err != nil {
+				return s, fmt.Errorf("exemplar: %s", err.Error())
 			}
 		}
+		return s, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return sample{}, fmt.Errorf("expected a number, got %s instead", reflect.TypeOf(v))
 	}
-	return merged
+	return sample{value: f}, nil
 }
 
-func (h *MetricsHandler) findCollector(name string) *Collector {
-	for _, c := range h.metrics {
-		if c.metric == name {
-			return &c
+// clusterLabels returns the labels of a metric that are filled in from the cluster that reported the value, rather than from its stats.
+func clusterLabels(m *Metric) []string {
+	if Config.ClusterLabels {
+		labels := []string{"cluster"}
+		if Config.ShardRangeLabel {
+			labels = append(labels, "shard_range")
 		}
+		return labels
+	}
+	if len(m.Labels) == 1 && m.Labels[0] == "cluster" {
+		return []string{"cluster"}
 	}
 	return nil
 }
 
-func (h *MetricsHandler) setCollector(labels prometheus.Labels, val float64, c *Collector) {
-	if v, ok := c.original.(prometheus.Gauge); ok {
-		v.Set(val)
-	} else if v, ok := c.original.(*prometheus.GaugeVec); ok {
-		v.With(labels).Set(val)
-	} else if v, ok := c.original.(prometheus.Counter); ok {
-		v.Add(val)
-	} else if v, ok := c.original.(*prometheus.CounterVec); ok {
-		v.With(labels).Add(val)
+// statLabels returns the labels of a metric that clusters fill in through their stats.
+func statLabels(m *Metric) []string {
+	labels := make([]string, 0, len(m.Labels))
+	for _, label := range m.Labels {
+		if !containsLabel(clusterLabels(m), label) {
+			labels = append(labels, label)
+		}
 	}
+	return labels
 }
 
-func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if GetHealthyClusters() < 1 {
-		w.WriteHeader(500)
-		return
-	}
-	clusterMetrics := make([]map[string]interface{}, 0, len(Server.Clients))
-	for _, cluster := range Server.Clients {
-		stats := cluster.RequestStats()
-		if stats == nil {
-			continue
+// exposedLabels returns every label of a metric, in the order sample labels are in.
+func exposedLabels(m *Metric) []string {
+	return append(clusterLabels(m), statLabels(m)...)
+}
+
+func containsLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
 		}
-		clusterMetrics = append(clusterMetrics, stats)
 	}
-	if Config.ExportDefaultMetrics {
-		h.clusterCount.Set(float64(Config.Clusters))
-		h.shardCount.Set(float64(Config.Shards))
+	return false
+}
+
+// parseSamples reads the value a cluster reported for a metric.
+// Anything as a nested object will be treated as a LABELED metric, and expects it's children stats to be values of the metric.
+// Cluster and shard_range are special labels, representing the cluster that reported the value.
+func parseSamples(m *Metric, c *Cluster, child interface{}) ([]sample, error) {
+	samples, err := parseStatSamples(m, statLabels(m), child)
+	if err != nil {
+		return nil, err
 	}
-	metrics := make(map[string]interface{})
-	if !Config.MergeMetrics {
-		metrics = clusterMetrics[0]
-	} else {
-		metrics = h.mergeMetrics(clusterMetrics)
+	values := make([]string, 0, 2)
+	for _, label := range clusterLabels(m) {
+		if label == "cluster" {
+			values = append(values, strconv.Itoa(c.ID))
+		} else {
+			values = append(values, fmt.Sprintf("%d-%d", c.FirstShardID(), c.LastShardID()-1))
+		}
 	}
-	for key, child := range metrics {
-		c := h.findCollector(key)
-		if c == nil {
-			continue
+	for i := range samples {
+		samples[i].labels = append(append([]string{}, values...), samples[i].labels...)
+	}
+	return samples, nil
+}
+
+// parseStatSamples reads the values of a metric with labels, which clusters can either report as nested objects, one level per label:
+// {"help": {"ok": 1, "failed": 2}} for labels ["command", "status"]
+// Or as an array of samples, where values are the same as they would be without labels:
+// [{"labels": {"command": "help", "status": "ok"}, "value": 1}]
+func parseStatSamples(m *Metric, labels []string, child interface{}) ([]sample, error) {
+	if list, ok := child.([]interface{}); ok {
+		return parseSampleList(m, labels, list)
+	}
+	samples := make([]sample, 0)
+	if err := parseNestedSamples(m, labels, nil, child, &samples); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+func parseNestedSamples(m *Metric, labels, values []string, child interface{}, samples *[]sample) error {
+	if len(values) == len(labels) {
+		s, err := parseValue(m, child)
+		if err != nil {
+			if len(values) > 0 {
+				return fmt.Errorf("%s: %s", strings.Join(values, "."), err.Error())
+			}
+			return err
 		}
-		m := findMetricByName(c.metric)
-		if m == nil {
-			continue
+		s.labels = append([]string{}, values...)
+		*samples = append(*samples, s)
+		return nil
+	}
+	data, ok := child.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("expected an object for label %s, got %s instead", labels[len(values)], reflect.TypeOf(child))
+	}
+	for key, v := range data {
+		if err := parseNestedSamples(m, labels, append(values, key), v, samples); err != nil {
+			return err
 		}
-		if f, ok := child.(float64); ok {
-			h.setCollector(nil, f, c)
+	}
+	return nil
+}
+
+func parseSampleList(m *Metric, labels []string, list []interface{}) ([]sample, error) {
+	samples := make([]sample, 0, len(list))
+	for i, item := range list {
+		data, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected sample %d to be an object, got %s instead", i, reflect.TypeOf(item))
+		}
+		given, ok := data["labels"].(map[string]interface{})
+		if !ok && len(labels) > 0 {
+			return nil, fmt.Errorf("expected sample %d to have an object of labels", i)
 		}
-		if data, ok := child.(map[string]interface{}); ok {
-			for key, v := range data {
-				f := v.(float64)
-				labels := prometheus.Labels{}
-				for _, label := range m.Labels {
-					labels[label] = key
+		if len(given) != len(labels) {
+			return nil, fmt.Errorf("expected sample %d to have the labels %v", i, labels)
+		}
+		values := make([]string, len(labels))
+		for j, label := range labels {
+			value, ok := given[label].(string)
+			if !ok {
+				return nil, fmt.Errorf("expected label %s of sample %d to be a string", label, i)
+			}
+			values[j] = value
+		}
+		s, err := parseValue(m, data["value"])
+		if err != nil {
+			return nil, fmt.Errorf("sample %d: %s", i, err.Error())
+		}
+		s.labels = values
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// observe records the cumulative value a cluster reported, returning how much it increased by.
+// A value lower than the last one means the cluster restarted, so the whole value is counted again.
+func (t *counterTracker) observe(cluster int, metric string, s sample) sample {
+	key := fmt.Sprintf("%d\xff%s\xff%s", cluster, metric, labelKey(s.labels))
+	last, ok := t.last[key]
+	t.last[key] = s
+	if !ok || s.value < last.value || s.reset(last) {
+		return s
+	}
+	delta := s.since(last)
+	delta.value = s.value - last.value
+	return delta
+}
+
+// add increases the total of a counter, histogram or summary, returning it.
+func (t *counterTracker) add(metric string, delta sample) *sample {
+	if _, ok := t.totals[metric]; !ok {
+		t.totals[metric] = make(map[string]*sample)
+	}
+	key := labelKey(delta.labels)
+	total, ok := t.totals[metric][key]
+	if !ok {
+		total = &sample{labels: delta.labels}
+		t.totals[metric][key] = total
+	}
+	total.value += delta.value
+	total.addDistribution(delta)
+	return total
+}
+
+// update replaces the values of every metric with the stats clusters reported, by cluster ID, the mutex must be held.
+// Gauges are summed between clusters, and counters, histograms and summaries keep growing from the increases each cluster reported.
+// When every metric has cluster labels, each cluster's values are exposed as they were reported instead.
+func (h *MetricsHandler) update(clusterMetrics map[int]map[string]interface{}) {
+	values := make(map[string]map[string]*sample)
+	quantiles := make(map[*sample][]sample)
+	for id, stats := range clusterMetrics {
+		for key, child := range stats {
+			m := h.findMetric(key)
+			if m == nil {
+				logrus.Warnf("Cluster %d has an unknown metric field %s!", id, key)
+				continue
+			}
+			samples, err := parseSamples(m, Server.Clients[id], child)
+			if err != nil {
+				h.statsErrors.WithLabelValues(key, strconv.Itoa(id)).Inc()
+				logrus.Errorf("Cluster %d reported an invalid value for metric %s: %s", id, key, err.Error())
+				continue
+			}
+			if _, ok := values[key]; !ok {
+				values[key] = make(map[string]*sample)
+			}
+			for _, s := range samples {
+				if m.Type != "gauge" && !Config.ClusterLabels {
+					total := h.counters.add(key, h.counters.observe(id, key, s))
+					if m.Type == "summary" {
+						quantiles[total] = append(quantiles[total], s)
+					}
+					continue
+				}
+				if merged, ok := values[key][labelKey(s.labels)]; ok {
+					merged.value += s.value
+				} else {
+					s := s
+					values[key][labelKey(s.labels)] = &s
 				}
-				h.setCollector(labels, f, c)
 			}
 		}
 	}
+	for total, samples := range quantiles {
+		total.quantiles = mergeQuantiles(samples)
+	}
+	for key, totals := range h.counters.totals {
+		values[key] = totals
+	}
+	h.values = values
+}
+
+// ServeHTTP always exposes the operator's own metrics, along with whatever stats the clusters that are up reported.
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.prepare()
 	prometheusHandler.ServeHTTP(w, req)
 }
+
+// prepare updates the metrics that aren't reported by clusters, right before they're exported.
+func (h *MetricsHandler) prepare() {
+	if Config.ExportDefaultMetrics {
+		h.clusterCount.Set(float64(Config.Clusters))
+		h.shardCount.Set(float64(Config.Shards))
+	}
+	h.markStale()
+}
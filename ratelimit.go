@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type RateLimit struct {
+	// How many requests per second are allowed (optional, 0 means unlimited)
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	// How many requests can be made at once before being limited to requestsPerSecond (optional, defaults to requestsPerSecond)
+	Burst int `json:"burst"`
+	// How many broadcast requests can be in-flight at once (optional, 0 means unlimited)
+	MaxInFlight int `json:"maxInFlight"`
+}
+
+// Limiter is a token bucket paired with a cap on in-flight requests.
+type Limiter struct {
+	mutex       *sync.Mutex
+	rate        float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	inFlight    int
+	maxInFlight int
+}
+
+var globalLimiter *Limiter
+
+func NewLimiter(limit RateLimit) *Limiter {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(limit.RequestsPerSecond))
+	}
+	return &Limiter{
+		mutex:       &sync.Mutex{},
+		rate:        limit.RequestsPerSecond,
+		burst:       burst,
+		tokens:      burst,
+		last:        time.Now(),
+		maxInFlight: limit.MaxInFlight,
+	}
+}
+
+// SetupLimits creates the global limiter, and a limiter for every token in the config.
+func SetupLimits() {
+	globalLimiter = NewLimiter(Config.RateLimit)
+	for i := range Config.Tokens {
+		limit := Config.TokenRateLimit
+		if Config.Tokens[i].RateLimit != nil {
+			limit = *Config.Tokens[i].RateLimit
+		}
+		Config.Tokens[i].limiter = NewLimiter(limit)
+	}
+}
+
+// Acquire takes a token from the bucket and an in-flight slot.
+// When either is unavailable, it returns false and how long the caller should wait before retrying.
+func (l *Limiter) Acquire() (time.Duration, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.maxInFlight > 0 && l.inFlight >= l.maxInFlight {
+		return time.Second, false
+	}
+	if l.rate > 0 {
+		now := time.Now()
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+		if l.tokens < 1 {
+			return time.Duration((1 - l.tokens) / l.rate * float64(time.Second)), false
+		}
+		l.tokens--
+	}
+	l.inFlight++
+	return 0, true
+}
+
+// Release frees the in-flight slot taken by Acquire.
+func (l *Limiter) Release() {
+	l.mutex.Lock()
+	l.inFlight--
+	l.mutex.Unlock()
+}
+
+// refund returns the token and in-flight slot taken by Acquire, for when a request was rejected by another limiter.
+func (l *Limiter) refund() {
+	l.mutex.Lock()
+	l.inFlight--
+	if l.rate > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+1)
+	}
+	l.mutex.Unlock()
+}
+
+// limitRequest applies the per-token and global limits to a request, writing a 429 when either has been reached.
+// The returned function must be called once the request has finished.
+func limitRequest(w http.ResponseWriter, token *ApiToken) (func(), bool) {
+	wait, ok := token.limiter.Acquire()
+	if !ok {
+		operatorMetrics.RateLimited(token)
+		writeRateLimited(w, wait, fmt.Sprintf("Token %s is being rate limited!", token.Name))
+		return nil, false
+	}
+	wait, ok = globalLimiter.Acquire()
+	if !ok {
+		token.limiter.refund()
+		operatorMetrics.RateLimited(token)
+		writeRateLimited(w, wait, "The operator is being rate limited!")
+		return nil, false
+	}
+	return func() {
+		globalLimiter.Release()
+		token.limiter.Release()
+	}, true
+}
+
+func writeRateLimited(w http.ResponseWriter, wait time.Duration, message string) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+	writeJson(w, 429, ApiResponse{Error: true, Message: message})
+}
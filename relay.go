@@ -1,65 +1,884 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"math/rand"
 	"net/http"
+	"path"
+	"sort"
 	"sync"
+	"time"
 )
 
+const (
+	RelayDispatch    = iota // client -> relay
+	RelayReceive            // relay -> client
+	RelaySubscribe          // client -> relay
+	RelayUnsubscribe        // client -> relay
+	RelayDirect             // client -> relay, relay -> client
+	RelayRequest            // client -> relay, relay -> client
+	RelayReply              // client -> relay, relay -> client
+	RelayError              // relay -> client
+	RelayRegister           // client -> relay
+	RelayWelcome            // relay -> client
+	RelayIdentify           // client -> relay
+	RelayPresence           // relay -> client
+	RelayResume             // client -> relay
+	RelayReceipt            // relay -> client
+	RelayAck                // client -> relay
+)
+
+// What happens when a client's outbound queue is full
+const (
+	SlowConsumerDropOldest = "drop_oldest"
+	SlowConsumerDropNew    = "drop_new"
+	SlowConsumerDisconnect = "disconnect"
+)
+
+type RelayConfig struct {
+	// How many messages can be queued for each client before slowConsumer applies (optional, default 256)
+	BufferSize int `json:"bufferSize"`
+	// Either drop_oldest, drop_new or disconnect (optional, default disconnect)
+	SlowConsumer string `json:"slowConsumer"`
+	// The largest message a client can send in bytes, clients sending larger ones are disconnected (optional, default 1048576)
+	MaxMessageSize int `json:"maxMessageSize"`
+	// How often clients are pinged in seconds (optional, default 30)
+	PingInterval int `json:"pingInterval"`
+	// How long a client can go without sending anything, including pongs, before it's disconnected in seconds (optional, default 60)
+	PongTimeout int `json:"pongTimeout"`
+	// How long a client can go without sending a packet before it's disconnected in seconds, pongs don't count (optional, disabled by default)
+	IdleTimeout int `json:"idleTimeout"`
+	// Either memory, where only this operator's clients can reach each other, or peer to share topics with other operators (optional, default memory)
+	Broker string `json:"broker"`
+	// The /relay/peer URLs of the other operators, such as ws://operator-2:3000/relay/peer, for the peer broker (optional)
+	Peers []string `json:"peers"`
+	// Topics whose latest messages are kept, so clients can catch up on them when they reconnect (optional)
+	Retention []RelayRetention `json:"retention"`
+	// A file retained messages are also written to, so they're kept when the operator restarts (optional)
+	Log string `json:"log"`
+}
+
+type RelayPacket struct {
+	Type int `json:"type"`
+	// Correlates requests with their replies, and errors with the packet that caused them
+	ID string `json:"id,omitempty"`
+	// The topic a message is published to, messages without a topic are sent to every client
+	Topic string `json:"topic,omitempty"`
+	// Topic names or patterns such as `guilds.*` to subscribe to or unsubscribe from
+	Topics []string `json:"topics,omitempty"`
+	// The ID of the client a direct message or request is sent to
+	To string `json:"to,omitempty"`
+	// The service a direct message or request is sent to, when it isn't sent to a specific client
+	Service string `json:"service,omitempty"`
+	// Services a client handles requests for
+	Services []string `json:"services,omitempty"`
+	// The ID of the client that sent a message
+	From string `json:"from,omitempty"`
+	// The operator a message was dispatched on, when relay messages are shared between several operators
+	Origin string `json:"origin,omitempty"`
+	// How long to wait for a reply in milliseconds (optional, default 5000)
+	Timeout int    `json:"timeout,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// A unique name a client identifies itself with, which direct messages and requests can also be sent to
+	Name string `json:"name,omitempty"`
+	// What kind of client this is, such as cluster, dashboard or worker
+	Role     string                 `json:"role,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// The sequence number of a dispatched message, and the last one a client saw when it resumes
+	Seq uint64 `json:"seq,omitempty"`
+	// The cluster that sent a message, when it was sent over the cluster's /ws connection
+	Cluster *int `json:"cluster,omitempty"`
+	// If the sender of a dispatch wants a receipt, and if the recipients of a message should acknowledge it
+	Ack bool `json:"ack,omitempty"`
+	// How many clients a dispatch was sent to, for receipts
+	Recipients *int `json:"recipients,omitempty"`
+	// The clients that acknowledged a dispatch and the ones that didn't in time, for final receipts
+	Acked   []string `json:"acked,omitempty"`
+	Missing []string `json:"missing,omitempty"`
+	// If this is the receipt sent once every recipient acknowledged a dispatch, or the timeout passed
+	Final bool `json:"final,omitempty"`
+	// If a message is being sent again because a client resumed
+	Replayed bool `json:"replayed,omitempty"`
+	// Either join or leave, for presence events
+	Event  string           `json:"event,omitempty"`
+	Client *RelayClientInfo `json:"client,omitempty"`
+	Body   interface{}      `json:"body,omitempty"`
+}
+
+// RelayClientInfo describes a connected client, for presence events and GET /relay/clients
+type RelayClientInfo struct {
+	ID          string                 `json:"id"`
+	Name        string                 `json:"name,omitempty"`
+	Role        string                 `json:"role,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	Topics      []string               `json:"topics"`
+	Services    []string               `json:"services"`
+	ConnectedAt time.Time              `json:"connectedAt"`
+}
+
+type RelayClient struct {
+	id          string
+	name        string
+	role        string
+	metadata    map[string]interface{}
+	connectedAt time.Time
+	// When the client last sent a packet
+	active time.Time
+	// The cluster this client is bridged from, for clusters using the relay over their /ws connection
+	cluster *int
+	// Writes a packet to the client, which is only ever called by the client's writer goroutine
+	write func(packet RelayPacket) error
+	// Disconnects the client, sending a close frame first when code is set
+	disconnect func(code int, reason string)
+	mutex      *sync.RWMutex
+	topics     map[string]bool
+	services   map[string]bool
+	// Packets waiting to be written by the client's writer goroutine
+	queue     chan RelayPacket
+	closed    chan struct{}
+	closeOnce *sync.Once
+	// Retained messages waiting to be replayed, one batch per resume, and if the replay goroutine is running
+	replays   [][]RelayPacket
+	replaying bool
+}
+
+// A request waiting for its reply, stored under the ID the relay gave it, so IDs from different clients can't collide.
+type relayRequest struct {
+	id    string
+	from  string
+	to    string
+	timer *time.Timer
+}
+
+// A dispatch waiting for its recipients to acknowledge it, stored under the ID the relay gave it.
+type relayAck struct {
+	id      string
+	seq     uint64
+	from    *RelayClient
+	pending map[string]bool
+	acked   []string
+	timer   *time.Timer
+}
+
 type RelayHandler struct {
-	mutex   *sync.RWMutex
-	clients map[string]*websocket.Conn
+	mutex    *sync.RWMutex
+	clients  map[string]*RelayClient
+	requests map[string]*relayRequest
+	acks     map[string]*relayAck
+	store    *RelayStore
+	broker   RelayBroker
+	// A random ID for this operator, which tells the messages its clients dispatched apart from other operators' messages
+	node string
+	// Held while a message is numbered and queued for its recipients, so each client is sent messages in the order of their sequence numbers
+	deliverMutex *sync.Mutex
+}
+
+type RelayClientsHandler struct{}
+
+var (
+	Relay *RelayHandler
+)
+
+func NewRelayHandler() *RelayHandler {
+	store, err := NewRelayStore()
+	if err != nil {
+		logrus.Fatalf("Failed to load the relay log %s: %s", Config.Relay.Log, err.Error())
+	}
+	rh := &RelayHandler{
+		mutex:        &sync.RWMutex{},
+		clients:      make(map[string]*RelayClient),
+		requests:     make(map[string]*relayRequest),
+		acks:         make(map[string]*relayAck),
+		store:        store,
+		node:         RandomID(),
+		deliverMutex: &sync.Mutex{},
+	}
+	if Config.Relay.Broker == RelayBrokerPeer {
+		rh.broker = NewPeerBroker(rh.node, Config.Relay.Peers)
+	} else {
+		rh.broker = &MemoryBroker{}
+	}
+	rh.broker.Start(rh.deliver)
+	return rh
+}
+
+func newRelayClient(id string, write func(packet RelayPacket) error, disconnect func(code int, reason string)) *RelayClient {
+	c := &RelayClient{
+		id:          id,
+		write:       write,
+		disconnect:  disconnect,
+		mutex:       &sync.RWMutex{},
+		topics:      make(map[string]bool),
+		services:    make(map[string]bool),
+		connectedAt: time.Now(),
+		active:      time.Now(),
+		queue:       make(chan RelayPacket, Config.Relay.BufferSize),
+		closed:      make(chan struct{}),
+		closeOnce:   &sync.Once{},
+	}
+	go c.writeLoop()
+	return c
+}
+
+func (c *RelayClient) writeLoop() {
+	for {
+		select {
+		case packet := <-c.queue:
+			if err := c.write(packet); err != nil {
+				c.Close()
+				return
+			}
+			operatorMetrics.RelayMessage("out")
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Send queues a packet for the client without waiting for it to be written, applying the slowConsumer policy when the queue is full.
+// It reports if the packet was queued.
+func (c *RelayClient) Send(packet RelayPacket) bool {
+	for {
+		select {
+		case <-c.closed:
+			return false
+		case c.queue <- packet:
+			return true
+		default:
+		}
+		operatorMetrics.RelayDropped(Config.Relay.SlowConsumer)
+		switch Config.Relay.SlowConsumer {
+		case SlowConsumerDropNew:
+			return false
+		case SlowConsumerDropOldest:
+			// Another sender could fill the queue again before this packet is queued, so this is tried until it fits
+			select {
+			case <-c.queue:
+			default:
+			}
+		default:
+			logrus.Warnf("Relay client %s is not keeping up with its messages, disconnecting it...", c.id)
+			c.CloseWithReason(websocket.ClosePolicyViolation, "too slow")
+			return false
+		}
+	}
+}
+
+// SendWait queues a packet for the client, waiting for room in the queue instead of applying the slowConsumer policy.
+func (c *RelayClient) SendWait(packet RelayPacket) {
+	select {
+	case <-c.closed:
+	case c.queue <- packet:
+	}
+}
+
+// Replay queues retained messages for the client on its own goroutine, as waiting for room in its queue would hold up
+// whatever reads the client's packets, which for a cluster is also where its pings are acknowledged.
+// Batches are replayed one after another, in the order Replay was called in.
+func (c *RelayClient) Replay(packets []RelayPacket) {
+	c.mutex.Lock()
+	c.replays = append(c.replays, packets)
+	start := !c.replaying
+	c.replaying = true
+	c.mutex.Unlock()
+	if start {
+		go c.replay()
+	}
 }
 
-func (rh *RelayHandler) putClient(id string, con *websocket.Conn) {
+func (c *RelayClient) replay() {
+	for {
+		c.mutex.Lock()
+		if len(c.replays) == 0 {
+			c.replaying = false
+			c.mutex.Unlock()
+			return
+		}
+		packets := c.replays[0]
+		c.replays = c.replays[1:]
+		c.mutex.Unlock()
+		for _, packet := range packets {
+			c.SendWait(packet)
+		}
+	}
+}
+
+// Close disconnects the client, which is then removed from the relay.
+func (c *RelayClient) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.disconnect(0, "")
+	})
+}
+
+// CloseWithReason disconnects the client with a close frame, without waiting for it to be sent, as the writer goroutine could be stuck writing to a slow client.
+func (c *RelayClient) CloseWithReason(code int, reason string) {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		go c.disconnect(code, reason)
+	})
+}
+
+func (c *RelayClient) SendError(id, err string) {
+	c.Send(RelayPacket{Type: RelayError, ID: id, Error: err})
+}
+
+func (c *RelayClient) Register(services []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, service := range services {
+		c.services[service] = true
+	}
+}
+
+// Info returns what other clients and the API can see about a client.
+func (c *RelayClient) Info() *RelayClientInfo {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	info := &RelayClientInfo{
+		ID:          c.id,
+		Name:        c.name,
+		Role:        c.role,
+		Metadata:    c.metadata,
+		Topics:      make([]string, 0, len(c.topics)),
+		Services:    make([]string, 0, len(c.services)),
+		ConnectedAt: c.connectedAt,
+	}
+	for topic := range c.topics {
+		info.Topics = append(info.Topics, topic)
+	}
+	for service := range c.services {
+		info.Services = append(info.Services, service)
+	}
+	sort.Strings(info.Topics)
+	sort.Strings(info.Services)
+	return info
+}
+
+func (c *RelayClient) Name() string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.name
+}
+
+func (c *RelayClient) Provides(service string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.services[service]
+}
+
+// Subscribe adds topic patterns, which are matched like `path.Match` patterns, so `guilds.*` matches every topic starting with `guilds.`
+func (c *RelayClient) Subscribe(patterns []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			logrus.Debugf("Relay client %s tried to subscribe to an invalid pattern %s", c.id, pattern)
+			continue
+		}
+		c.topics[pattern] = true
+	}
+}
+
+func (c *RelayClient) Unsubscribe(patterns []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, pattern := range patterns {
+		delete(c.topics, pattern)
+	}
+}
+
+// Subscribed reports if any of the client's subscriptions match a topic.
+func (c *RelayClient) Subscribed(topic string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.topics[topic] {
+		return true
+	}
+	for pattern := range c.topics {
+		if ok, _ := path.Match(pattern, topic); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (rh *RelayHandler) putClient(c *RelayClient) {
 	rh.mutex.Lock()
-	rh.clients[id] = con
+	rh.clients[c.id] = c
 	rh.mutex.Unlock()
+	operatorMetrics.RelayConnected()
 }
 
-func (rh *RelayHandler) deleteClient(id string) {
+// deleteClient removes a client from the relay, unless another client with the same ID replaced it already.
+func (rh *RelayHandler) deleteClient(c *RelayClient) {
+	id := c.id
 	rh.mutex.Lock()
+	if rh.clients[id] != c {
+		rh.mutex.Unlock()
+		return
+	}
 	delete(rh.clients, id)
+	failed := make([]*relayRequest, 0)
+	for key, req := range rh.requests {
+		if req.to == id && req.timer.Stop() {
+			delete(rh.requests, key)
+			failed = append(failed, req)
+		}
+	}
 	rh.mutex.Unlock()
+	operatorMetrics.RelayDisconnected()
+	for _, req := range failed {
+		if c := rh.getClient(req.from); c != nil {
+			c.SendError(req.id, "target disconnected")
+		}
+	}
+	if c.Name() != "" {
+		rh.broadcastPresence("leave", c)
+	}
 }
 
-func (rh *RelayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	client, err := Server.Upgrader.Upgrade(w, r, nil)
+// Identify names a client, which is only allowed once, and lets every other client know it joined.
+func (rh *RelayHandler) Identify(c *RelayClient, packet *RelayPacket) {
+	if packet.Name == "" {
+		c.SendError(packet.ID, "name is required")
+		return
+	}
+	rh.mutex.Lock()
+	if c.Name() != "" {
+		rh.mutex.Unlock()
+		c.SendError(packet.ID, "already identified")
+		return
+	}
+	for _, other := range rh.clients {
+		if other.Name() == packet.Name {
+			rh.mutex.Unlock()
+			c.SendError(packet.ID, fmt.Sprintf("name %s is already in use", packet.Name))
+			return
+		}
+	}
+	c.mutex.Lock()
+	c.name, c.role, c.metadata = packet.Name, packet.Role, packet.Metadata
+	c.mutex.Unlock()
+	rh.mutex.Unlock()
+	rh.broadcastPresence("join", c)
+}
+
+func (rh *RelayHandler) broadcastPresence(event string, c *RelayClient) {
+	info := c.Info()
+	rh.mutex.RLock()
+	defer rh.mutex.RUnlock()
+	for id, other := range rh.clients {
+		if id == c.id {
+			continue
+		}
+		other.Send(RelayPacket{Type: RelayPresence, Event: event, Client: info})
+	}
+}
+
+// Clients returns every connected client, oldest first, only including the clients subscribed to topic when it's set.
+func (rh *RelayHandler) Clients(topic string) []*RelayClientInfo {
+	rh.mutex.RLock()
+	defer rh.mutex.RUnlock()
+	clients := make([]*RelayClientInfo, 0, len(rh.clients))
+	for _, c := range rh.clients {
+		if topic != "" && !c.Subscribed(topic) {
+			continue
+		}
+		clients = append(clients, c.Info())
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ConnectedAt.Before(clients[j].ConnectedAt)
+	})
+	return clients
+}
+
+func (_ *RelayClientsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if authorize(w, r, "GET") == nil {
+		return
+	}
+	writeJson(w, 200, ApiResponse{Data: Relay.Clients(r.URL.Query().Get("topic"))})
+}
+
+func (rh *RelayHandler) getClient(id string) *RelayClient {
+	rh.mutex.RLock()
+	defer rh.mutex.RUnlock()
+	return rh.clients[id]
+}
+
+// target finds the client a direct message or request is for, either by its ID or name, or by a service it provides.
+// When several clients provide the service, one of them is picked at random.
+func (rh *RelayHandler) target(packet *RelayPacket) (*RelayClient, error) {
+	if packet.To != "" {
+		if c := rh.getClient(packet.To); c != nil {
+			return c, nil
+		}
+		rh.mutex.RLock()
+		defer rh.mutex.RUnlock()
+		for _, c := range rh.clients {
+			if c.Name() == packet.To {
+				return c, nil
+			}
+		}
+		return nil, fmt.Errorf("client %s is not connected", packet.To)
+	}
+	if packet.Service == "" {
+		return nil, fmt.Errorf("either to or service is required")
+	}
+	rh.mutex.RLock()
+	providers := make([]*RelayClient, 0)
+	for _, c := range rh.clients {
+		if c.Provides(packet.Service) {
+			providers = append(providers, c)
+		}
+	}
+	rh.mutex.RUnlock()
+	if len(providers) < 1 {
+		return nil, fmt.Errorf("no client provides service %s", packet.Service)
+	}
+	return providers[rand.Intn(len(providers))], nil
+}
+
+// Direct sends a message to a single client.
+func (rh *RelayHandler) Direct(from *RelayClient, packet *RelayPacket) {
+	target, err := rh.target(packet)
 	if err != nil {
+		from.SendError(packet.ID, err.Error())
 		return
 	}
-	if r.Header.Get("authorization") == "" || r.Header.Get("authorization") != Config.Auth {
-		_ = client.Close()
+	target.Send(RelayPacket{Type: RelayDirect, ID: packet.ID, From: from.id, Cluster: from.cluster, Body: packet.Body})
+}
+
+// Request sends a request to a single client, and sends an error back if it doesn't reply in time.
+func (rh *RelayHandler) Request(from *RelayClient, packet *RelayPacket) {
+	if packet.ID == "" {
+		from.SendError("", "id is required for requests")
+		return
+	}
+	target, err := rh.target(packet)
+	if err != nil {
+		from.SendError(packet.ID, err.Error())
+		return
+	}
+	timeout := 5 * time.Second
+	if packet.Timeout > 0 {
+		timeout = time.Duration(packet.Timeout) * time.Millisecond
+	}
+	key := RandomID()
+	req := &relayRequest{id: packet.ID, from: from.id, to: target.id}
+	rh.mutex.Lock()
+	req.timer = time.AfterFunc(timeout, func() {
+		rh.mutex.Lock()
+		delete(rh.requests, key)
+		rh.mutex.Unlock()
+		from.SendError(req.id, "timed out")
+	})
+	rh.requests[key] = req
+	rh.mutex.Unlock()
+	target.Send(RelayPacket{Type: RelayRequest, ID: key, From: from.id, Cluster: from.cluster, Body: packet.Body})
+}
+
+// Reply sends a reply back to the client that made the request, as long as it's still waiting for it.
+func (rh *RelayHandler) Reply(from *RelayClient, packet *RelayPacket) {
+	rh.mutex.Lock()
+	req, ok := rh.requests[packet.ID]
+	// Only the client the request was sent to can reply to it
+	if !ok || req.to != from.id || !req.timer.Stop() {
+		rh.mutex.Unlock()
+		from.SendError(packet.ID, "no request is waiting for this reply")
+		return
+	}
+	delete(rh.requests, packet.ID)
+	requester := rh.clients[req.from]
+	rh.mutex.Unlock()
+	if requester != nil {
+		requester.Send(RelayPacket{Type: RelayReply, ID: req.id, From: from.id, Cluster: from.cluster, Body: packet.Body})
+	}
+}
+
+// Dispatch hands a message to the broker, which delivers it to the subscribers of its topic on this operator, and on every other operator it reaches.
+func (rh *RelayHandler) Dispatch(from *RelayClient, packet *RelayPacket) {
+	packet.Cluster = from.cluster
+	packet.From = from.id
+	packet.Origin = rh.node
+	rh.broker.Publish(packet)
+}
+
+// deliver sends a message to every client subscribed to its topic, or to every client when it has no topic, apart from the client that sent it.
+// Messages are numbered, and retained before they're sent, so a client resuming at the same time gets them one way or another.
+// When the sender is connected to this operator and asks for a receipt, it's told how many of this operator's clients the message was sent to,
+// and with a timeout, which of them acknowledged it in time.
+func (rh *RelayHandler) deliver(packet *RelayPacket) {
+	rh.deliverMutex.Lock()
+	defer rh.deliverMutex.Unlock()
+	rh.store.Append(packet)
+	var from *RelayClient
+	if packet.Origin == rh.node {
+		from = rh.getClient(packet.From)
+	}
+	var ack *relayAck
+	key := ""
+	if from != nil && packet.Ack && packet.Timeout > 0 {
+		ack = &relayAck{id: packet.ID, seq: packet.Seq, from: from, pending: make(map[string]bool)}
+		key = RandomID()
+	}
+	// The write lock is held when acknowledgements are collected, so a recipient can't acknowledge the message before it's expected
+	lock, unlock := rh.mutex.RLock, rh.mutex.RUnlock
+	if ack != nil {
+		lock, unlock = rh.mutex.Lock, rh.mutex.Unlock
+	}
+	lock()
+	recipients := 0
+	for id, c := range rh.clients {
+		if c == from || (packet.Topic != "" && !c.Subscribed(packet.Topic)) {
+			continue
+		}
+		sent := c.Send(RelayPacket{
+			Type:    RelayReceive,
+			ID:      key,
+			Topic:   packet.Topic,
+			Seq:     packet.Seq,
+			From:    packet.From,
+			Cluster: packet.Cluster,
+			Ack:     ack != nil,
+			Body:    packet.Body,
+		})
+		if !sent {
+			continue
+		}
+		recipients++
+		if ack != nil {
+			ack.pending[id] = true
+		}
+	}
+	if ack != nil && recipients > 0 {
+		rh.acks[key] = ack
+		ack.timer = time.AfterFunc(time.Duration(packet.Timeout)*time.Millisecond, func() {
+			rh.finishAck(key)
+		})
+	}
+	unlock()
+	if from == nil || !packet.Ack {
+		return
+	}
+	from.Send(RelayPacket{Type: RelayReceipt, ID: packet.ID, Seq: packet.Seq, Recipients: &recipients})
+	if ack != nil && recipients == 0 {
+		from.Send(RelayPacket{Type: RelayReceipt, ID: packet.ID, Seq: packet.Seq, Recipients: &recipients, Final: true})
+	}
+}
+
+// Ack records that a client acknowledged a message, sending the final receipt once every recipient did.
+func (rh *RelayHandler) Ack(c *RelayClient, packet *RelayPacket) {
+	rh.mutex.Lock()
+	ack, ok := rh.acks[packet.ID]
+	if !ok || !ack.pending[c.id] {
+		rh.mutex.Unlock()
+		return
+	}
+	delete(ack.pending, c.id)
+	ack.acked = append(ack.acked, c.id)
+	done := len(ack.pending) == 0 && ack.timer.Stop()
+	rh.mutex.Unlock()
+	if done {
+		rh.finishAck(packet.ID)
+	}
+}
+
+// finishAck sends the final receipt of a message, with every recipient that didn't acknowledge it as missing.
+func (rh *RelayHandler) finishAck(key string) {
+	rh.mutex.Lock()
+	ack, ok := rh.acks[key]
+	delete(rh.acks, key)
+	rh.mutex.Unlock()
+	if !ok {
+		return
+	}
+	missing := make([]string, 0, len(ack.pending))
+	for id := range ack.pending {
+		missing = append(missing, id)
+	}
+	sort.Strings(missing)
+	recipients := len(ack.acked) + len(missing)
+	ack.from.Send(RelayPacket{
+		Type:       RelayReceipt,
+		ID:         ack.id,
+		Seq:        ack.seq,
+		Recipients: &recipients,
+		Acked:      ack.acked,
+		Missing:    missing,
+		Final:      true,
+	})
+}
+
+// Resume subscribes a client to topics, and replays every retained message of those topics it missed since seq.
+// The client is subscribed first, so messages dispatched while it resumes might be sent twice, but never missed.
+func (rh *RelayHandler) Resume(c *RelayClient, packet *RelayPacket) {
+	c.Subscribe(packet.Topics)
+	retained := rh.store.Since(packet.Topics, packet.Seq)
+	packets := make([]RelayPacket, 0, len(retained))
+	for _, missed := range retained {
+		packets = append(packets, RelayPacket{
+			Type:     RelayReceive,
+			Topic:    missed.Topic,
+			Seq:      missed.Seq,
+			From:     missed.From,
+			Cluster:  missed.Cluster,
+			Replayed: true,
+			Body:     missed.Body,
+		})
+	}
+	c.Replay(packets)
+}
+
+func (rh *RelayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Unauthorized clients are turned away before the connection is upgraded, so they never hold a websocket
+	if FindToken(r.Header.Get("authorization")) == nil {
+		writeJson(w, 403, ApiResponse{Error: true, Message: "Forbidden"})
 		return
 	}
 	id := RandomID()
 	if id == "" {
+		writeJson(w, 500, ApiResponse{Error: true, Message: "Unable to create a client ID!"})
 		return
 	}
-	rh.putClient(id, client)
+	client, err := Server.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	timeout := time.Duration(Config.Relay.PongTimeout) * time.Second
+	client.SetReadLimit(int64(Config.Relay.MaxMessageSize))
+	_ = client.SetReadDeadline(time.Now().Add(timeout))
+	client.SetPongHandler(func(string) error {
+		return client.SetReadDeadline(time.Now().Add(timeout))
+	})
+	c := newRelayClient(id, func(packet RelayPacket) error {
+		_ = client.SetWriteDeadline(time.Now().Add(timeout))
+		return client.WriteJSON(packet)
+	}, func(code int, reason string) {
+		if code > 0 {
+			// WriteControl is the only write that's allowed to happen at the same time as the writer goroutine's
+			_ = client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+		}
+		_ = client.Close()
+	})
+	rh.putClient(c)
+	c.Send(RelayPacket{Type: RelayWelcome, ID: id})
+	go c.heartbeat(client, time.Duration(Config.Relay.PingInterval)*time.Second, time.Duration(Config.Relay.IdleTimeout)*time.Second)
 	go func() {
 		for {
-			packet := Packet{}
-			err := client.ReadJSON(&packet)
+			_, message, err := client.ReadMessage()
+			// Clients sending messages over maxMessageSize were already sent a close frame by websocket
 			if err != nil {
-				rh.deleteClient(id)
+				c.Close()
+				rh.deleteClient(c)
 				return
 			}
-			// Type 0 is dispatch
-			// Type 1 is receive
-			if packet.Type == 0 {
-				rh.mutex.RLock()
-				for i, c := range rh.clients {
-					if i == id {
-						continue
-					}
-					_ = c.WriteJSON(Packet{
-						Type: 1,
-						Body: packet.Body,
-					})
-				}
-				rh.mutex.RUnlock()
+			_ = client.SetReadDeadline(time.Now().Add(timeout))
+			packet := &RelayPacket{}
+			if err := json.Unmarshal(message, packet); err != nil {
+				operatorMetrics.RelayMessage("in")
+				c.SendError("", fmt.Sprintf("malformed packet: %s", err.Error()))
+				continue
 			}
+			rh.Handle(c, packet)
 		}
 	}()
 }
+
+// heartbeat pings a client every pingInterval, and disconnects it once it hasn't sent a packet for idleTimeout.
+// Clients that don't respond to pings are disconnected by their read deadline.
+func (c *RelayClient) heartbeat(conn *websocket.Conn, interval time.Duration, idleTimeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			if idleTimeout > 0 && c.Idle() > idleTimeout {
+				logrus.Debugf("Relay client %s has been idle for too long, disconnecting it...", c.id)
+				c.CloseWithReason(websocket.CloseGoingAway, "idle timeout")
+				return
+			}
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// Idle returns how long ago the client last sent a packet.
+func (c *RelayClient) Idle() time.Duration {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return time.Since(c.active)
+}
+
+// Handle acts on a packet a client sent.
+func (rh *RelayHandler) Handle(c *RelayClient, packet *RelayPacket) {
+	operatorMetrics.RelayMessage("in")
+	c.mutex.Lock()
+	c.active = time.Now()
+	c.mutex.Unlock()
+	switch packet.Type {
+	case RelayDispatch:
+		rh.Dispatch(c, packet)
+	case RelaySubscribe:
+		c.Subscribe(packet.Topics)
+	case RelayUnsubscribe:
+		c.Unsubscribe(packet.Topics)
+	case RelayDirect:
+		rh.Direct(c, packet)
+	case RelayRequest:
+		rh.Request(c, packet)
+	case RelayReply:
+		rh.Reply(c, packet)
+	case RelayRegister:
+		c.Register(packet.Services)
+	case RelayIdentify:
+		rh.Identify(c, packet)
+	case RelayResume:
+		rh.Resume(c, packet)
+	case RelayAck:
+		rh.Ack(c, packet)
+	default:
+		c.SendError(packet.ID, fmt.Sprintf("unknown packet type %d", packet.Type))
+	}
+}
+
+// HandleCluster acts on a relay packet a cluster sent over its /ws connection, the first one adds the cluster to the relay as `cluster-<id>`.
+func (rh *RelayHandler) HandleCluster(cluster *Cluster, packet *RelayPacket) {
+	id := fmt.Sprintf("cluster-%d", cluster.ID)
+	rh.mutex.Lock()
+	c, ok := rh.clients[id]
+	if !ok {
+		var client *RelayClient
+		client = newRelayClient(id, func(packet RelayPacket) error {
+			cluster.Write(RelayMessage, packet)
+			return nil
+		}, func(_ int, _ string) {
+			// The cluster stays connected, it's only removed from the relay until it sends another relay packet
+			go rh.deleteClient(client)
+		})
+		c = client
+		c.cluster = &cluster.ID
+		rh.clients[id] = c
+	}
+	rh.mutex.Unlock()
+	if !ok {
+		operatorMetrics.RelayConnected()
+		c.Send(RelayPacket{Type: RelayWelcome, ID: id})
+	}
+	rh.Handle(c, packet)
+}
+
+// RemoveCluster removes a cluster from the relay when it disconnects.
+func (rh *RelayHandler) RemoveCluster(cluster *Cluster) {
+	if c := rh.getClient(fmt.Sprintf("cluster-%d", cluster.ID)); c != nil {
+		c.Close()
+	}
+}
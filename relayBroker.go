@@ -0,0 +1,257 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RelayBrokerMemory = "memory"
+	RelayBrokerPeer   = "peer"
+)
+
+// RelayBroker fans dispatched messages out, to the clients of this operator, and of any other operator the broker reaches.
+type RelayBroker interface {
+	// Start makes the broker hand every message to deliver, whether it was published on this operator or another one
+	Start(deliver func(packet *RelayPacket))
+	// Publish delivers a message on every operator the broker reaches, this one included
+	Publish(packet *RelayPacket)
+}
+
+// MemoryBroker only delivers messages to this operator's clients.
+type MemoryBroker struct {
+	deliver func(packet *RelayPacket)
+}
+
+func (b *MemoryBroker) Start(deliver func(packet *RelayPacket)) {
+	b.deliver = deliver
+}
+
+func (b *MemoryBroker) Publish(packet *RelayPacket) {
+	b.deliver(packet)
+}
+
+// PeerBroker links operators to each other, every operator sends the messages its clients dispatched to the operators it's linked to,
+// which pass them on to the operators they're linked to, so operators don't all have to be linked to each other.
+// Operators either dial the peers in their config, or are dialed by them on /relay/peer, and a message reaching an operator twice is only delivered and passed on once.
+type PeerBroker struct {
+	node    string
+	peers   []string
+	deliver func(packet *RelayPacket)
+	counter uint64
+	mutex   *sync.RWMutex
+	links   map[*peerLink]bool
+	// The messages from other operators that were delivered lately, oldest first, so they're not delivered twice
+	seen  map[peerKey]bool
+	order []peerKey
+}
+
+type PeerHandler struct{}
+
+type peerKey struct {
+	node string
+	id   uint64
+}
+
+type peerMessage struct {
+	// The operator that published the message, and its number on that operator
+	Node   string      `json:"node"`
+	ID     uint64      `json:"id"`
+	Packet RelayPacket `json:"packet"`
+}
+
+type peerLink struct {
+	name      string
+	conn      *websocket.Conn
+	queue     chan peerMessage
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+// How many delivered messages are remembered to skip duplicates, and how long to wait before dialing a peer again
+const (
+	peerSeenSize  = 10000
+	peerRetryWait = 5 * time.Second
+)
+
+func NewPeerBroker(node string, peers []string) *PeerBroker {
+	return &PeerBroker{
+		node:  node,
+		peers: peers,
+		mutex: &sync.RWMutex{},
+		links: make(map[*peerLink]bool),
+		seen:  make(map[peerKey]bool),
+	}
+}
+
+func (b *PeerBroker) Start(deliver func(packet *RelayPacket)) {
+	b.deliver = deliver
+	for _, peer := range b.peers {
+		go b.dial(peer)
+	}
+}
+
+func (b *PeerBroker) Publish(packet *RelayPacket) {
+	msg := peerMessage{Node: b.node, ID: atomic.AddUint64(&b.counter, 1), Packet: *packet}
+	b.deliver(packet)
+	b.forward(msg, nil)
+}
+
+// forward sends a message to every linked operator, apart from the one it came from.
+func (b *PeerBroker) forward(msg peerMessage, from *peerLink) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for link := range b.links {
+		if link != from {
+			link.send(msg)
+		}
+	}
+}
+
+// receive delivers a message from another operator and passes it on, unless it was received already through another link.
+func (b *PeerBroker) receive(msg peerMessage, from *peerLink) {
+	if msg.Node == b.node {
+		return
+	}
+	key := peerKey{node: msg.Node, id: msg.ID}
+	b.mutex.Lock()
+	if b.seen[key] {
+		b.mutex.Unlock()
+		return
+	}
+	b.seen[key] = true
+	b.order = append(b.order, key)
+	if len(b.order) > peerSeenSize {
+		delete(b.seen, b.order[0])
+		b.order = b.order[1:]
+	}
+	b.mutex.Unlock()
+	// Sequence numbers are given by each operator
+	packet := msg.Packet
+	packet.Seq = 0
+	b.deliver(&packet)
+	b.forward(msg, from)
+}
+
+// dial keeps a link to a peer open, connecting again whenever it's lost.
+func (b *PeerBroker) dial(url string) {
+	header := http.Header{}
+	header.Set("Authorization", Config.Auth)
+	for {
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		if err != nil {
+			logrus.Warnf("Failed to connect to relay peer %s: %s", url, err.Error())
+		} else {
+			logrus.Infof("Connected to relay peer %s", url)
+			b.run(url, conn)
+			logrus.Warnf("Lost connection to relay peer %s", url)
+		}
+		time.Sleep(peerRetryWait)
+	}
+}
+
+// run sends published messages to a peer and delivers the messages it sends, until the link is lost.
+func (b *PeerBroker) run(name string, conn *websocket.Conn) {
+	link := &peerLink{
+		name:      name,
+		conn:      conn,
+		queue:     make(chan peerMessage, Config.Relay.BufferSize),
+		closed:    make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	timeout := time.Duration(Config.Relay.PongTimeout) * time.Second
+	// Messages are wrapped with where they came from, so they can be a bit larger than what clients can send
+	conn.SetReadLimit(int64(Config.Relay.MaxMessageSize) * 2)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(timeout))
+	})
+	b.mutex.Lock()
+	b.links[link] = true
+	b.mutex.Unlock()
+	go link.writeLoop(time.Duration(Config.Relay.PingInterval)*time.Second, timeout)
+	for {
+		msg := peerMessage{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			break
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		b.receive(msg, link)
+	}
+	link.close()
+	b.mutex.Lock()
+	delete(b.links, link)
+	b.mutex.Unlock()
+}
+
+// send queues a message for the peer, dropping it when the peer isn't keeping up.
+func (l *peerLink) send(msg peerMessage) {
+	select {
+	case l.queue <- msg:
+	case <-l.closed:
+	default:
+		operatorMetrics.RelayDropped(SlowConsumerDropNew)
+		logrus.Warnf("Relay peer %s is not keeping up, dropping a message", l.name)
+	}
+}
+
+func (l *peerLink) writeLoop(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-l.queue:
+			_ = l.conn.SetWriteDeadline(time.Now().Add(timeout))
+			if err := l.conn.WriteJSON(msg); err != nil {
+				l.close()
+				return
+			}
+		case <-ticker.C:
+			if err := l.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+				l.close()
+				return
+			}
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+func (l *peerLink) close() {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		_ = l.conn.Close()
+	})
+}
+
+// ServeHTTP accepts links from other operators using the peer broker, which authenticate with the same auth token as clusters.
+// The other entries of tokens aren't accepted, since a link receives every message and can dispatch as any client.
+func (_ *PeerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	broker, ok := Relay.broker.(*PeerBroker)
+	if !ok {
+		writeJson(w, 404, ApiResponse{Error: true, Message: "The peer broker is not enabled!"})
+		return
+	}
+	if r.Header.Get("authorization") == "" || r.Header.Get("authorization") != Config.Auth {
+		writeJson(w, 403, ApiResponse{Error: true, Message: "Forbidden"})
+		return
+	}
+	broker.accept(w, r)
+}
+
+// accept upgrades a link another operator dialed, and runs it until it's lost.
+func (b *PeerBroker) accept(w http.ResponseWriter, r *http.Request) {
+	conn, err := Server.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	logrus.Infof("Relay peer %s connected", r.RemoteAddr)
+	go func() {
+		b.run(r.RemoteAddr, conn)
+		logrus.Warnf("Relay peer %s disconnected", r.RemoteAddr)
+	}()
+}
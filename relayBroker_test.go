@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPeerRelay returns a relay using the peer broker, along with the /relay/peer URL other operators can link to it on.
+func newPeerRelay(t *testing.T) (*RelayHandler, string) {
+	if Config.Relay.Broker != RelayBrokerPeer {
+		newTestRelay(t)
+		Config.Relay.Broker = RelayBrokerPeer
+		Config.Relay.MaxMessageSize = 1048576
+		Config.Relay.PingInterval = 30
+		Config.Relay.PongTimeout = 60
+		server := Server
+		t.Cleanup(func() { Server = server })
+		Server = &WSServer{}
+	}
+	rh := NewRelayHandler()
+	broker := rh.broker.(*PeerBroker)
+	s := httptest.NewServer(http.HandlerFunc(broker.accept))
+	t.Cleanup(s.Close)
+	// Links are closed before the config they read is restored
+	t.Cleanup(func() {
+		broker.mutex.RLock()
+		for link := range broker.links {
+			link.close()
+		}
+		broker.mutex.RUnlock()
+		for links(rh) > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	return rh, "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+// link makes an operator dial another one, like it does for the peers in its config, and waits until both sides are linked.
+func link(t *testing.T, from *RelayHandler, to *RelayHandler, url string) {
+	t.Helper()
+	fromLinks, toLinks := links(from), links(to)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go from.broker.(*PeerBroker).run(url, conn)
+	deadline := time.Now().Add(2 * time.Second)
+	for links(from) == fromLinks || links(to) == toLinks {
+		if time.Now().After(deadline) {
+			t.Fatal("the operators were not linked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func links(rh *RelayHandler) int {
+	broker := rh.broker.(*PeerBroker)
+	broker.mutex.RLock()
+	defer broker.mutex.RUnlock()
+	return len(broker.links)
+}
+
+// receiveOnce fails unless exactly one packet is received.
+func receiveOnce(t *testing.T, packets chan RelayPacket) RelayPacket {
+	t.Helper()
+	packet := receive(t, packets)
+	select {
+	case duplicate := <-packets:
+		t.Fatalf("received a second packet: %+v", duplicate)
+	case <-time.After(200 * time.Millisecond):
+	}
+	return packet
+}
+
+// Operators that dial each other have two links, but deliver each message once.
+func TestPeerBrokerLinkedBothWays(t *testing.T) {
+	a, urlA := newPeerRelay(t)
+	b, urlB := newPeerRelay(t)
+	link(t, a, b, urlB)
+	link(t, b, a, urlA)
+
+	sender, _ := testClient(t, a, "sender")
+	local, localPackets := testClient(t, a, "local")
+	local.Subscribe([]string{"events"})
+	remote, remotePackets := testClient(t, b, "remote")
+	remote.Subscribe([]string{"events"})
+	a.Dispatch(sender, &RelayPacket{Type: RelayDispatch, Topic: "events", Body: "hello"})
+
+	if packet := receiveOnce(t, remotePackets); packet.From != "sender" || packet.Body != "hello" {
+		t.Errorf("packet on the other operator = %+v", packet)
+	}
+	if packet := receiveOnce(t, localPackets); packet.From != "sender" || packet.Body != "hello" {
+		t.Errorf("packet on the same operator = %+v", packet)
+	}
+}
+
+// Messages are passed on, so operators that aren't linked to each other directly still share them.
+// In a ring of 4 operators, the one across from the sender receives messages from both sides, and delivers them once.
+func TestPeerBrokerForwards(t *testing.T) {
+	a, urlA := newPeerRelay(t)
+	b, urlB := newPeerRelay(t)
+	c, urlC := newPeerRelay(t)
+	d, urlD := newPeerRelay(t)
+	link(t, a, b, urlB)
+	link(t, b, c, urlC)
+	link(t, c, d, urlD)
+	link(t, d, a, urlA)
+
+	sender, _ := testClient(t, a, "sender")
+	subscribers := make([]chan RelayPacket, 0, 3)
+	for _, rh := range []*RelayHandler{b, c, d} {
+		client, packets := testClient(t, rh, RandomID())
+		client.Subscribe([]string{"events"})
+		subscribers = append(subscribers, packets)
+	}
+	a.Dispatch(sender, &RelayPacket{Type: RelayDispatch, Topic: "events", Body: "hello"})
+	for i, packets := range subscribers {
+		if packet := receiveOnce(t, packets); packet.Body != "hello" {
+			t.Errorf("packet on operator %d = %+v", i+1, packet)
+		}
+	}
+}
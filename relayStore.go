@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+type RelayRetention struct {
+	// A topic name or pattern, matched like subscriptions are (REQUIRED)
+	Topic string `json:"topic"`
+	// How many of the latest messages are kept for each topic it matches (REQUIRED)
+	Size int `json:"size"`
+}
+
+// RelayStore numbers every dispatched message, and keeps the latest messages of retained topics so clients can catch up on them.
+type RelayStore struct {
+	mutex *sync.Mutex
+	seq   uint64
+	rings map[string][]RelayPacket
+	file  *os.File
+	// Messages written to the log since it was last compacted
+	logged int
+}
+
+// NewRelayStore loads the messages in the relay log, if there is one, and compacts it down to the messages that are still retained.
+// Sequence numbers start from the current time in microseconds, so they keep increasing when the operator restarts without a log.
+func NewRelayStore() (*RelayStore, error) {
+	s := &RelayStore{
+		mutex: &sync.Mutex{},
+		seq:   uint64(time.Now().UnixNano() / int64(time.Microsecond)),
+		rings: make(map[string][]RelayPacket),
+	}
+	if Config.Relay.Log == "" {
+		return s, nil
+	}
+	file, err := os.Open(Config.Relay.Log)
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			packet := RelayPacket{}
+			if err := json.Unmarshal(scanner.Bytes(), &packet); err != nil {
+				continue
+			}
+			if packet.Seq > s.seq {
+				s.seq = packet.Seq
+			}
+			s.retain(packet)
+		}
+		_ = file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return s, s.compact()
+}
+
+// retention returns how many messages are kept for a topic, which is 0 when the topic isn't retained.
+func retention(topic string) int {
+	for _, r := range Config.Relay.Retention {
+		if ok, _ := path.Match(r.Topic, topic); ok || r.Topic == topic {
+			return r.Size
+		}
+	}
+	return 0
+}
+
+// retain adds a message to the ring of its topic, dropping the oldest message once it's full. The mutex must be held.
+func (s *RelayStore) retain(packet RelayPacket) bool {
+	size := retention(packet.Topic)
+	if packet.Topic == "" || size < 1 {
+		return false
+	}
+	ring := append(s.rings[packet.Topic], packet)
+	if len(ring) > size {
+		ring = ring[len(ring)-size:]
+	}
+	s.rings[packet.Topic] = ring
+	return true
+}
+
+// Append gives a message the next sequence number, retaining and logging it when its topic is retained.
+func (s *RelayStore) Append(packet *RelayPacket) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.seq++
+	packet.Seq = s.seq
+	if !s.retain(*packet) || s.file == nil {
+		return
+	}
+	line, err := json.Marshal(packet)
+	if err != nil {
+		return
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		logrus.Errorf("Failed to write to the relay log: %s", err.Error())
+		return
+	}
+	s.logged++
+	// Most of the log is messages that were pushed out of their rings, so it's rewritten with only the retained ones
+	if s.logged > 1000 && s.logged > 2*s.retained() {
+		if err := s.compact(); err != nil {
+			logrus.Errorf("Failed to compact the relay log: %s", err.Error())
+		}
+	}
+}
+
+func (s *RelayStore) retained() int {
+	count := 0
+	for _, ring := range s.rings {
+		count += len(ring)
+	}
+	return count
+}
+
+// Since returns the retained messages after seq of every topic matching the patterns, oldest first.
+func (s *RelayStore) Since(patterns []string, seq uint64) []RelayPacket {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.since(patterns, seq)
+}
+
+// since is Since with the mutex held, every topic is included when patterns is nil.
+func (s *RelayStore) since(patterns []string, seq uint64) []RelayPacket {
+	packets := make([]RelayPacket, 0)
+	for topic, ring := range s.rings {
+		if patterns != nil && !matchesAny(patterns, topic) {
+			continue
+		}
+		for _, packet := range ring {
+			if packet.Seq > seq {
+				packets = append(packets, packet)
+			}
+		}
+	}
+	sort.Slice(packets, func(i, j int) bool {
+		return packets[i].Seq < packets[j].Seq
+	})
+	return packets
+}
+
+// compact rewrites the log with only the retained messages, the mutex must be held (or the store not shared yet).
+func (s *RelayStore) compact() error {
+	if s.file != nil {
+		_ = s.file.Close()
+		s.file = nil
+	}
+	packets := s.since(nil, 0)
+	tmp := Config.Relay.Log + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, packet := range packets {
+		line, err := json.Marshal(packet)
+		if err != nil {
+			continue
+		}
+		_, _ = writer.Write(append(line, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, Config.Relay.Log); err != nil {
+		return err
+	}
+	s.file, err = os.OpenFile(Config.Relay.Log, os.O_APPEND|os.O_WRONLY, 0600)
+	s.logged = len(packets)
+	return err
+}
+
+func matchesAny(patterns []string, topic string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, topic); ok || pattern == topic {
+			return true
+		}
+	}
+	return false
+}
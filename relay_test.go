@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestRelay returns a relay with the memory broker, retaining the latest 1000 messages of the events topic.
+func newTestRelay(t *testing.T) *RelayHandler {
+	config := Config
+	t.Cleanup(func() { Config = config })
+	Config.Relay = RelayConfig{
+		BufferSize:   4096,
+		SlowConsumer: SlowConsumerDropNew,
+		Broker:       RelayBrokerMemory,
+		Retention:    []RelayRetention{{Topic: "events", Size: 1000}},
+	}
+	if operatorMetrics == nil {
+		NewOperatorMetrics()
+	}
+	return NewRelayHandler()
+}
+
+// testClient adds a client to the relay, which hands every packet it's sent to the channel.
+func testClient(t *testing.T, rh *RelayHandler, id string) (*RelayClient, chan RelayPacket) {
+	packets := make(chan RelayPacket, 4096)
+	var c *RelayClient
+	c = newRelayClient(id, func(packet RelayPacket) error {
+		packets <- packet
+		return nil
+	}, func(_ int, _ string) {
+		go rh.deleteClient(c)
+	})
+	rh.putClient(c)
+	t.Cleanup(c.Close)
+	return c, packets
+}
+
+func receive(t *testing.T, packets chan RelayPacket) RelayPacket {
+	t.Helper()
+	select {
+	case packet := <-packets:
+		return packet
+	case <-time.After(2 * time.Second):
+		t.Fatal("no packet was received")
+		return RelayPacket{}
+	}
+}
+
+// Messages dispatched at the same time are sent to each client in the order of their sequence numbers,
+// so a client resuming from the last one it received doesn't skip any.
+func TestDeliverInSeqOrder(t *testing.T) {
+	rh := newTestRelay(t)
+	subscriber, packets := testClient(t, rh, "subscriber")
+	subscriber.Subscribe([]string{"events"})
+	senders, messages := 8, 500
+	wg := &sync.WaitGroup{}
+	for i := 0; i < senders; i++ {
+		sender, _ := testClient(t, rh, RandomID())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				rh.Dispatch(sender, &RelayPacket{Type: RelayDispatch, Topic: "events"})
+			}
+		}()
+	}
+	wg.Wait()
+	last := uint64(0)
+	for i := 0; i < senders*messages; i++ {
+		packet := receive(t, packets)
+		if packet.Seq <= last {
+			t.Fatalf("message %d has seq %d, after seq %d", i, packet.Seq, last)
+		}
+		last = packet.Seq
+	}
+}
+
+func TestResumeReplaysSender(t *testing.T) {
+	rh := newTestRelay(t)
+	sender, _ := testClient(t, rh, "sender")
+	rh.Dispatch(sender, &RelayPacket{Type: RelayDispatch, Topic: "events", Body: "hello"})
+
+	resumed, packets := testClient(t, rh, "resumed")
+	rh.Resume(resumed, &RelayPacket{Type: RelayResume, Topics: []string{"events"}})
+	packet := receive(t, packets)
+	if !packet.Replayed || packet.From != "sender" || packet.Topic != "events" || packet.Body != "hello" {
+		t.Errorf("replayed packet = %+v", packet)
+	}
+}
+
+// Replaying more messages than fit in a client's queue doesn't hold up whoever handles its packets,
+// which for a cluster is also where its pings are acknowledged.
+func TestResumeDoesNotBlock(t *testing.T) {
+	rh := newTestRelay(t)
+	sender, _ := testClient(t, rh, "sender")
+	for i := 0; i < 20; i++ {
+		rh.Dispatch(sender, &RelayPacket{Type: RelayDispatch, Topic: "events", Body: i})
+	}
+	Config.Relay.BufferSize = 4
+	release := make(chan struct{})
+	packets := make(chan RelayPacket, 100)
+	c := newRelayClient("resumed", func(packet RelayPacket) error {
+		<-release
+		packets <- packet
+		return nil
+	}, func(_ int, _ string) {})
+	t.Cleanup(c.Close)
+
+	resumed := make(chan struct{})
+	go func() {
+		rh.Resume(c, &RelayPacket{Type: RelayResume, Topics: []string{"events"}})
+		rh.Resume(c, &RelayPacket{Type: RelayResume, Topics: []string{"events"}})
+		close(resumed)
+	}()
+	select {
+	case <-resumed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Resume waited for the client to be sent the replayed messages")
+	}
+	close(release)
+	for i := 0; i < 40; i++ {
+		if packet := receive(t, packets); packet.Body != i%20 {
+			t.Fatalf("replayed message %d has body %v, want %d", i, packet.Body, i%20)
+		}
+	}
+}
+
+// Named tokens can connect to /relay like they can use the HTTP API.
+func TestRelayAcceptsNamedTokens(t *testing.T) {
+	rh := newTestRelay(t)
+	Config.Auth = "secret"
+	Config.Tokens = []ApiToken{{Name: "dashboard", Token: "named"}, {Name: "default", Token: "secret"}}
+	Config.Relay.MaxMessageSize = 1048576
+	Config.Relay.PingInterval = 30
+	Config.Relay.PongTimeout = 60
+	server := Server
+	t.Cleanup(func() { Server = server })
+	Server = &WSServer{}
+	s := httptest.NewServer(rh)
+	t.Cleanup(s.Close)
+	// Clients are removed before the config they read is restored
+	t.Cleanup(func() {
+		for {
+			rh.mutex.RLock()
+			clients := len(rh.clients)
+			rh.mutex.RUnlock()
+			if clients == 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	for _, token := range []string{"secret", "named"} {
+		conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {token}})
+		if err != nil {
+			t.Fatalf("token %s: %v", token, err)
+		}
+		packet := RelayPacket{}
+		if err := conn.ReadJSON(&packet); err != nil || packet.Type != RelayWelcome {
+			t.Errorf("token %s was sent %+v, %v", token, packet, err)
+		}
+		_ = conn.Close()
+	}
+	if _, res, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"wrong"}}); err == nil || res.StatusCode != 403 {
+		t.Errorf("an unknown token should be rejected with a 403, got %v", err)
+	}
+}
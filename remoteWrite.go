@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type RemoteWriteConfig struct {
+	// The remote write endpoint, such as http://localhost:9090/api/v1/write (nothing is pushed when empty)
+	URL string `json:"url"`
+	// How often metrics are pushed in seconds (optional, default 30)
+	Interval int `json:"interval"`
+	// How long to wait for the endpoint to respond in milliseconds (optional, default 10000)
+	Timeout int `json:"timeout"`
+	// Extra headers sent with every push, such as Authorization (optional)
+	Headers map[string]string `json:"headers"`
+}
+
+// A single series of the remote write protocol, labels include __name__ and are sorted by name.
+type remoteSeries struct {
+	labels [][2]string
+	value  float64
+}
+
+// remoteWriteLoop pushes every registered metric to the remote write endpoint on an interval.
+func (h *MetricsHandler) remoteWriteLoop() {
+	client := &http.Client{Timeout: time.Duration(Config.RemoteWrite.Timeout) * time.Millisecond}
+	ticker := time.NewTicker(time.Duration(Config.RemoteWrite.Interval) * time.Second)
+	for range ticker.C {
+		if err := h.remoteWrite(client); err != nil {
+			operatorMetrics.WebhookFailed("remote_write")
+			logrus.Errorf("Failed to push metrics to the remote write endpoint: %s", err.Error())
+		}
+	}
+}
+
+func (h *MetricsHandler) remoteWrite(client *http.Client) error {
+	h.prepare()
+	families, err := registry.Gather()
+	if err != nil {
+		// Gather still returns whatever metrics it could collect
+		logrus.Warnf("Some metrics could not be gathered for remote write: %s", err.Error())
+	}
+	return pushRemoteWrite(client, families, time.Now())
+}
+
+// pushRemoteWrite sends metric families to the remote write endpoint, timestamped with now.
+func pushRemoteWrite(client *http.Client, families []*dto.MetricFamily, now time.Time) error {
+	body := snappy.Encode(nil, encodeWriteRequest(families, now))
+	req, err := http.NewRequest("POST", Config.RemoteWrite.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range Config.RemoteWrite.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("endpoint responded with %s: %s", res.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// remoteSeriesOf flattens a metric family into series, the way prometheus would store them after a scrape.
+func remoteSeriesOf(family *dto.MetricFamily) []remoteSeries {
+	series := make([]remoteSeries, 0, len(family.Metric))
+	name := family.GetName()
+	for _, m := range family.Metric {
+		add := func(name string, value float64, extra ...string) {
+			labels := make([][2]string, 0, len(m.Label)+2)
+			labels = append(labels, [2]string{"__name__", name})
+			for _, pair := range m.Label {
+				labels = append(labels, [2]string{pair.GetName(), pair.GetValue()})
+			}
+			for i := 0; i+1 < len(extra); i += 2 {
+				labels = append(labels, [2]string{extra[i], extra[i+1]})
+			}
+			sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+			series = append(series, remoteSeries{labels: labels, value: value})
+		}
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			add(name, m.Counter.GetValue())
+		case dto.MetricType_GAUGE:
+			add(name, m.Gauge.GetValue())
+		case dto.MetricType_UNTYPED:
+			add(name, m.Untyped.GetValue())
+		case dto.MetricType_HISTOGRAM:
+			infinite := false
+			for _, bucket := range m.Histogram.Bucket {
+				infinite = infinite || math.IsInf(bucket.GetUpperBound(), 1)
+				add(name+"_bucket", float64(bucket.GetCumulativeCount()), "le", formatBound(bucket.GetUpperBound()))
+			}
+			if !infinite {
+				add(name+"_bucket", float64(m.Histogram.GetSampleCount()), "le", "+Inf")
+			}
+			add(name+"_sum", m.Histogram.GetSampleSum())
+			add(name+"_count", float64(m.Histogram.GetSampleCount()))
+		case dto.MetricType_SUMMARY:
+			for _, q := range m.Summary.Quantile {
+				add(name, q.GetValue(), "quantile", formatBound(q.GetQuantile()))
+			}
+			add(name+"_sum", m.Summary.GetSampleSum())
+			add(name+"_count", float64(m.Summary.GetSampleCount()))
+		}
+	}
+	return series
+}
+
+func formatBound(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes metric families as a remote write WriteRequest protobuf message:
+// WriteRequest{1: repeated TimeSeries}, TimeSeries{1: repeated Label, 2: repeated Sample},
+// Label{1: name, 2: value}, Sample{1: double value, 2: int64 timestamp in milliseconds}
+func encodeWriteRequest(families []*dto.MetricFamily, now time.Time) []byte {
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	var buf []byte
+	for _, family := range families {
+		for _, s := range remoteSeriesOf(family) {
+			var ts []byte
+			for _, label := range s.labels {
+				var l []byte
+				l = protowire.AppendTag(l, 1, protowire.BytesType)
+				l = protowire.AppendString(l, label[0])
+				l = protowire.AppendTag(l, 2, protowire.BytesType)
+				l = protowire.AppendString(l, label[1])
+				ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+				ts = protowire.AppendBytes(ts, l)
+			}
+			var sample []byte
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(timestamp))
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, sample)
+			buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+			buf = protowire.AppendBytes(buf, ts)
+		}
+	}
+	return buf
+}
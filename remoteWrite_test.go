@@ -0,0 +1,213 @@
+package main
+
+import (
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type decodedSeries struct {
+	labels    [][2]string
+	value     float64
+	timestamp int64
+}
+
+// decodeWriteRequest decodes a remote write WriteRequest, independently from how encodeWriteRequest builds it.
+func decodeWriteRequest(t *testing.T, b []byte) []decodedSeries {
+	series := make([]decodedSeries, 0)
+	for _, ts := range decodeMessages(t, b, 1) {
+		s := decodedSeries{}
+		for _, label := range decodeMessages(t, ts, 1) {
+			fields := decodeStrings(t, label)
+			s.labels = append(s.labels, [2]string{fields[1], fields[2]})
+		}
+		samples := decodeMessages(t, ts, 2)
+		if len(samples) != 1 {
+			t.Fatalf("expected 1 sample per series, got %d", len(samples))
+		}
+		b := samples[0]
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatalf("invalid sample tag: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+			switch {
+			case num == 1 && typ == protowire.Fixed64Type:
+				v, n := protowire.ConsumeFixed64(b)
+				s.value = math.Float64frombits(v)
+				b = b[n:]
+			case num == 2 && typ == protowire.VarintType:
+				v, n := protowire.ConsumeVarint(b)
+				s.timestamp = int64(v)
+				b = b[n:]
+			default:
+				t.Fatalf("unexpected sample field %d of type %d", num, typ)
+			}
+		}
+		series = append(series, s)
+	}
+	return series
+}
+
+// decodeMessages returns every embedded message with the field number, failing on fields of other types.
+func decodeMessages(t *testing.T, b []byte, field protowire.Number) [][]byte {
+	messages := make([][]byte, 0)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			t.Fatalf("field %d should be length delimited, got type %d", num, typ)
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		if num == field {
+			messages = append(messages, v)
+		}
+	}
+	return messages
+}
+
+func decodeStrings(t *testing.T, b []byte) map[protowire.Number]string {
+	fields := make(map[protowire.Number]string)
+	for len(b) > 0 {
+		num, _, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		v, n := protowire.ConsumeString(b)
+		if n < 0 {
+			t.Fatalf("invalid string field %d: %v", num, protowire.ParseError(n))
+		}
+		fields[num] = v
+		b = b[n:]
+	}
+	return fields
+}
+
+func TestPushRemoteWrite(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	commands := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "commands_total", Help: "Commands"}, []string{"name"})
+	latency := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency", Help: "Latency", Buckets: []float64{0.1, 1}})
+	reg.MustRegister(commands, latency)
+	commands.WithLabelValues("help").Add(3)
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, want := range map[string]string{
+			"Content-Encoding":                  "snappy",
+			"Content-Type":                      "application/x-protobuf",
+			"X-Prometheus-Remote-Write-Version": "0.1.0",
+			"Authorization":                     "Bearer secret",
+		} {
+			if got := r.Header.Get(name); got != want {
+				t.Errorf("header %s = %q, want %q", name, got, want)
+			}
+		}
+		compressed, _ := ioutil.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("body is not snappy compressed: %v", err)
+		}
+		received = body
+		w.WriteHeader(204)
+	}))
+	defer server.Close()
+	Config.RemoteWrite = RemoteWriteConfig{URL: server.URL, Headers: map[string]string{"Authorization": "Bearer secret"}}
+
+	now := time.Unix(1630000000, 500*int64(time.Millisecond))
+	if err := pushRemoteWrite(server.Client(), families, now); err != nil {
+		t.Fatal(err)
+	}
+	series := decodeWriteRequest(t, received)
+
+	want := []decodedSeries{
+		{labels: [][2]string{{"__name__", "commands_total"}, {"name", "help"}}, value: 3},
+		{labels: [][2]string{{"__name__", "latency_bucket"}, {"le", "0.1"}}, value: 1},
+		{labels: [][2]string{{"__name__", "latency_bucket"}, {"le", "1"}}, value: 2},
+		{labels: [][2]string{{"__name__", "latency_bucket"}, {"le", "+Inf"}}, value: 3},
+		{labels: [][2]string{{"__name__", "latency_sum"}}, value: 5.55},
+		{labels: [][2]string{{"__name__", "latency_count"}}, value: 3},
+	}
+	if len(series) != len(want) {
+		t.Fatalf("got %d series, want %d: %+v", len(series), len(want), series)
+	}
+	for i, s := range series {
+		if !reflect.DeepEqual(s.labels, want[i].labels) {
+			t.Errorf("series %d labels = %v, want %v", i, s.labels, want[i].labels)
+		}
+		if math.Abs(s.value-want[i].value) > 1e-9 {
+			t.Errorf("series %d value = %v, want %v", i, s.value, want[i].value)
+		}
+		if s.timestamp != 1630000000500 {
+			t.Errorf("series %d timestamp = %d, want 1630000000500", i, s.timestamp)
+		}
+	}
+}
+
+func TestPushRemoteWriteError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", 400)
+	}))
+	defer server.Close()
+	Config.RemoteWrite = RemoteWriteConfig{URL: server.URL}
+	err := pushRemoteWrite(server.Client(), nil, time.Now())
+	if err == nil || err.Error() != "endpoint responded with 400 Bad Request: out of order sample" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// A histogram that already has a +Inf bucket shouldn't get a second one.
+func TestRemoteSeriesOfInfiniteBucket(t *testing.T) {
+	desc := prometheus.NewDesc("sizes", "Sizes", nil, nil)
+	m := prometheus.MustNewConstHistogram(desc, 4, 10, map[float64]uint64{1: 2, math.Inf(1): 4})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(constCollector{desc: desc, metric: m})
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	infinite := 0
+	for _, s := range remoteSeriesOf(families[0]) {
+		for _, label := range s.labels {
+			if label == [2]string{"le", "+Inf"} {
+				infinite++
+				if s.value != 4 {
+					t.Errorf("+Inf bucket = %v, want 4", s.value)
+				}
+			}
+		}
+	}
+	if infinite != 1 {
+		t.Errorf("got %d +Inf buckets, want 1", infinite)
+	}
+}
+
+type constCollector struct {
+	desc   *prometheus.Desc
+	metric prometheus.Metric
+}
+
+func (c constCollector) Describe(ch chan<- *prometheus.Desc) { ch <- c.desc }
+func (c constCollector) Collect(ch chan<- prometheus.Metric) { ch <- c.metric }
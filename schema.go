@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+)
+
+type EntityType struct {
+	// The entity type clusters handle (REQUIRED)
+	Name string `json:"name"`
+	// The arguments this entity accepts, any argument that isn't listed is rejected (optional)
+	Args map[string]*ArgSpec `json:"args"`
+	// How long to wait for each cluster to respond in milliseconds (optional, default 5000)
+	Timeout int `json:"timeout"`
+	// How long responses are cached for in milliseconds (optional, 0 disables caching)
+	CacheTTL int `json:"cacheTTL"`
+	// How long responses can be served after cacheTTL while they're refreshed in the background, in milliseconds (optional)
+	StaleTTL int `json:"staleTTL"`
+}
+
+type ArgSpec struct {
+	// One of string, number, integer, boolean, object or array (REQUIRED)
+	Type string `json:"type"`
+	// If the argument has to be present
+	Required bool `json:"required"`
+	// The only values the argument can be (optional)
+	Enum []interface{} `json:"enum"`
+	// A regular expression strings have to match (optional)
+	Pattern string `json:"pattern"`
+	// Bounds on the length of strings and arrays (optional)
+	MinLength *int `json:"minLength"`
+	MaxLength *int `json:"maxLength"`
+	// Bounds on numbers and integers (optional)
+	Minimum *float64 `json:"minimum"`
+	Maximum *float64 `json:"maximum"`
+	// The spec every element of an array has to match (optional)
+	Items *ArgSpec `json:"items"`
+	// The fields of an object, any field that isn't listed is rejected (optional)
+	Properties map[string]*ArgSpec `json:"properties"`
+	pattern    *regexp.Regexp
+}
+
+func findEntityType(name string) *EntityType {
+	for i := range Config.Entities {
+		if Config.Entities[i].Name == name {
+			return &Config.Entities[i]
+		}
+	}
+	return nil
+}
+
+// compile checks the spec and parses its patterns, this is called when the config is loaded.
+func (s *ArgSpec) compile(path string) error {
+	if s == nil {
+		return fmt.Errorf("%s should be an object with the argument's type, received: null", path)
+	}
+	switch s.Type {
+	case "string", "number", "integer", "boolean", "object", "array":
+	default:
+		return fmt.Errorf("%s.type should be string, number, integer, boolean, object or array, received: %s", path, s.Type)
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s.pattern is invalid: %s", path, err.Error())
+		}
+		s.pattern = re
+	}
+	if s.Items != nil {
+		if err := s.Items.compile(path + ".items"); err != nil {
+			return err
+		}
+	}
+	for name, property := range s.Properties {
+		if err := property.compile(path + ".properties." + name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateArgs checks the arguments of an entity request against the entity's spec.
+// Entities without any args in their spec can't be given any.
+func (e *EntityType) ValidateArgs(args map[string]interface{}) error {
+	return validateFields("args", e.Args, args)
+}
+
+func validateFields(path string, specs map[string]*ArgSpec, values map[string]interface{}) error {
+	for name := range values {
+		if _, ok := specs[name]; !ok {
+			return fmt.Errorf("%s.%s is not a known argument!", path, name)
+		}
+	}
+	for name, spec := range specs {
+		value, ok := values[name]
+		if !ok || value == nil {
+			if spec.Required {
+				return fmt.Errorf("%s.%s is required!", path, name)
+			}
+			continue
+		}
+		if err := spec.Validate(path+"."+name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks a decoded JSON value against the spec.
+func (s *ArgSpec) Validate(path string, value interface{}) error {
+	if len(s.Enum) > 0 && !s.inEnum(value) {
+		return fmt.Errorf("%s is not one of the allowed values!", path)
+	}
+	switch s.Type {
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s should be a string!", path)
+		}
+		if err := s.validateLength(path, len([]rune(str))); err != nil {
+			return err
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			return fmt.Errorf("%s does not match %s!", path, s.Pattern)
+		}
+	case "number", "integer":
+		f, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("%s should be a %s!", path, s.Type)
+		}
+		if s.Type == "integer" && f != math.Trunc(f) {
+			return fmt.Errorf("%s should be an integer!", path)
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%s should be at least %v!", path, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fmt.Errorf("%s should be at most %v!", path, *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s should be a boolean!", path)
+		}
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s should be an object!", path)
+		}
+		if s.Properties != nil {
+			return validateFields(path, s.Properties, obj)
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s should be an array!", path)
+		}
+		if err := s.validateLength(path, len(arr)); err != nil {
+			return err
+		}
+		if s.Items != nil {
+			for i, item := range arr {
+				if err := s.Items.Validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *ArgSpec) validateLength(path string, length int) error {
+	if s.MinLength != nil && length < *s.MinLength {
+		return fmt.Errorf("%s should have a length of at least %d!", path, *s.MinLength)
+	}
+	if s.MaxLength != nil && length > *s.MaxLength {
+		return fmt.Errorf("%s should have a length of at most %d!", path, *s.MaxLength)
+	}
+	return nil
+}
+
+func (s *ArgSpec) inEnum(value interface{}) bool {
+	for _, v := range s.Enum {
+		if reflect.DeepEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
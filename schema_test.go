@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Specs that are null in the config are rejected with their path, instead of panicking.
+func TestCompileNullSpec(t *testing.T) {
+	for raw, want := range map[string]string{
+		`{"type": "object", "properties": {"id": null}}`:                                  "args.guild.properties.id should be an object with the argument's type, received: null",
+		`{"type": "array", "items": {"type": "object", "properties": {"id": null}}}`:      "args.guild.items.properties.id should be an object with the argument's type, received: null",
+		`{"type": "object", "properties": {"id": {"type": "string", "pattern": "[a-z"}}}`: "args.guild.properties.id.pattern is invalid: error parsing regexp: missing closing ]: `[a-z`",
+	} {
+		spec := &ArgSpec{}
+		if err := json.Unmarshal([]byte(raw), spec); err != nil {
+			t.Fatal(err)
+		}
+		if err := spec.compile("args.guild"); err == nil || err.Error() != want {
+			t.Errorf("compile(%s) = %v, want %s", raw, err, want)
+		}
+	}
+	var spec *ArgSpec
+	if err := spec.compile("args.id"); err == nil || err.Error() != "args.id should be an object with the argument's type, received: null" {
+		t.Errorf("compile(null) = %v", err)
+	}
+}
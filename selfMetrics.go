@@ -0,0 +1,178 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+)
+
+// OperatorMetrics are metrics about the operator itself, rather than the stats clusters report.
+// They're always recorded, but only exported when exportDefaultMetrics is enabled.
+type OperatorMetrics struct {
+	clusterState     *prometheus.Desc
+	pingRTT          *prometheus.HistogramVec
+	missedPings      *prometheus.CounterVec
+	reconnects       *prometheus.CounterVec
+	requests         *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	rateLimited      *prometheus.CounterVec
+	relayConnections prometheus.Gauge
+	relayMessages    *prometheus.CounterVec
+	relayDropped     *prometheus.CounterVec
+	webhookFailures  *prometheus.CounterVec
+}
+
+var (
+	operatorMetrics *OperatorMetrics
+)
+
+func NewOperatorMetrics() {
+	if operatorMetrics != nil {
+		panic("Tried to initialise another operator metrics instance.")
+	}
+	operatorMetrics = &OperatorMetrics{
+		clusterState: prometheus.NewDesc(
+			MetricPrefix("cluster_state"),
+			"The state of each cluster, 0 is waiting, 1 is connecting and 2 is ready!",
+			[]string{"cluster"},
+			nil,
+		),
+		pingRTT: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    MetricPrefix("cluster_ping_rtt_seconds"),
+			Help:    "How long each cluster took to acknowledge pings!",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"cluster"}),
+		missedPings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: MetricPrefix("cluster_missed_pings_total"),
+			Help: "Pings each cluster did not acknowledge!",
+		}, []string{"cluster"}),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: MetricPrefix("cluster_reconnects_total"),
+			Help: "Times each cluster connected again after its first connection!",
+		}, []string{"cluster"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: MetricPrefix("requests_total"),
+			Help: "Eval and entity requests by outcome!",
+		}, []string{"kind", "outcome"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    MetricPrefix("request_duration_seconds"),
+			Help:    "How long eval and entity requests took by outcome!",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"kind", "outcome"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: MetricPrefix("rate_limited_total"),
+			Help: "Requests rejected by rate limits, by token!",
+		}, []string{"token"}),
+		relayConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: MetricPrefix("relay_connections"),
+			Help: "Clients connected to the relay!",
+		}),
+		relayMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: MetricPrefix("relay_messages_total"),
+			Help: "Messages the relay received (in) and sent (out)!",
+		}, []string{"direction"}),
+		relayDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: MetricPrefix("relay_dropped_messages_total"),
+			Help: "Messages the relay dropped because a client's queue was full, by slow consumer policy!",
+		}, []string{"policy"}),
+		webhookFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: MetricPrefix("webhook_failures_total"),
+			Help: "Failed deliveries to the log webhook, audit sink and remote write endpoint!",
+		}, []string{"webhook"}),
+	}
+}
+
+// register adds the operator metrics, along with go runtime and process metrics to the registry.
+func (m *OperatorMetrics) register() {
+	collectors := []prometheus.Collector{
+		m,
+		m.pingRTT,
+		m.missedPings,
+		m.reconnects,
+		m.requests,
+		m.requestDuration,
+		m.rateLimited,
+		m.relayConnections,
+		m.relayMessages,
+		m.relayDropped,
+		m.webhookFailures,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	}
+	for _, collector := range collectors {
+		if err := registry.Register(collector); err != nil {
+			logrus.Errorf("Failed to register operator metric: %s", err.Error())
+		}
+	}
+}
+
+func (m *OperatorMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.clusterState
+}
+
+// Collect exposes the current state of every cluster.
+func (m *OperatorMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, cluster := range Server.Clients {
+		ch <- prometheus.MustNewConstMetric(m.clusterState, prometheus.GaugeValue, float64(cluster.State), strconv.Itoa(cluster.ID))
+	}
+}
+
+func (m *OperatorMetrics) ObservePing(c *Cluster, rtt time.Duration) {
+	m.pingRTT.WithLabelValues(strconv.Itoa(c.ID)).Observe(rtt.Seconds())
+}
+
+func (m *OperatorMetrics) MissedPing(c *Cluster) {
+	m.missedPings.WithLabelValues(strconv.Itoa(c.ID)).Inc()
+}
+
+func (m *OperatorMetrics) Reconnected(c *Cluster) {
+	m.reconnects.WithLabelValues(strconv.Itoa(c.ID)).Inc()
+}
+
+// ObserveRequest records a finished eval or entity request.
+// The outcome is rejected, cached, timeout (a cluster timed out), error (a cluster returned an error) or ok.
+func (m *OperatorMetrics) ObserveRequest(e *AuditEntry) {
+	outcome := "ok"
+	if e.Error != "" {
+		outcome = "rejected"
+	} else if e.Cache == CacheHit || e.Cache == CacheStale || e.Cache == CacheCoalesced {
+		outcome = "cached"
+	} else {
+		for _, res := range e.Results {
+			if res.Timeout {
+				outcome = "timeout"
+				break
+			}
+			if res.Error != "" {
+				outcome = "error"
+			}
+		}
+	}
+	m.requests.WithLabelValues(e.Kind, outcome).Inc()
+	m.requestDuration.WithLabelValues(e.Kind, outcome).Observe(time.Since(e.Time).Seconds())
+}
+
+func (m *OperatorMetrics) RateLimited(token *ApiToken) {
+	m.rateLimited.WithLabelValues(token.Name).Inc()
+}
+
+func (m *OperatorMetrics) RelayConnected() {
+	m.relayConnections.Inc()
+}
+
+func (m *OperatorMetrics) RelayDisconnected() {
+	m.relayConnections.Dec()
+}
+
+func (m *OperatorMetrics) RelayMessage(direction string) {
+	m.relayMessages.WithLabelValues(direction).Inc()
+}
+
+func (m *OperatorMetrics) RelayDropped(policy string) {
+	m.relayDropped.WithLabelValues(policy).Inc()
+}
+
+func (m *OperatorMetrics) WebhookFailed(webhook string) {
+	m.webhookFailures.WithLabelValues(webhook).Inc()
+}
@@ -26,6 +26,9 @@ const (
 	Ready                   // client -> server
 	Entity
 	EntityAck
+	MetricDescriptors // client -> server
+	StatsIncrement    // client -> server
+	RelayMessage      // client -> server, server -> client
 )
 
 type WSServer struct {
@@ -91,14 +94,20 @@ func (w *WSServer) DeleteEntityChan(id string) {
 }
 
 func (*SocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	client, err := Server.Upgrader.Upgrade(w, r, nil)
-	if err != nil {
+	// Like on /relay, clusters are turned away before the connection is upgraded, so they're told why
+	if r.Header.Get("authorization") == "" || r.Header.Get("authorization") != Config.Auth {
+		writeJson(w, 403, ApiResponse{Error: true, Message: "Forbidden"})
 		return
 	}
-	if r.Header.Get("authorization") == "" || r.Header.Get("authorization") != Config.Auth {
-		_ = client.Close()
+	if NextClusterID() == -1 {
+		writeJson(w, 503, ApiResponse{Error: true, Message: "No cluster is waiting for a connection!"})
 		return
 	}
+	client, err := Server.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	// Another cluster may have connected while this one was upgraded
 	id := NextClusterID()
 	if id == -1 {
 		_ = client.Close()
@@ -107,6 +116,10 @@ func (*SocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	c := Server.Clients[id]
 	c.Client = client
 	c.State = ClusterConnecting
+	c.connects++
+	if c.connects > 1 {
+		operatorMetrics.Reconnected(c)
+	}
 	go func() {
 		for {
 			var packet *Packet
@@ -115,23 +128,32 @@ func (*SocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				c.Terminate()
 				break
 			}
-			go c.HandleMessage(packet)
+			switch packet.Type {
+			case Eval, BroadcastEval, EntityAck, StatsAck, StatsIncrement:
+				// These can take a while, and don't depend on the order packets arrive in
+				go c.HandleMessage(packet)
+			default:
+				// Relay packets in particular have to be handled in order, like they are on /relay
+				c.HandleMessage(packet)
+			}
 		}
 	}()
 }
 
 func (w *WSServer) Listen() {
-	h := &MetricsHandler{}
-	h.Setup()
+	Metrics = &MetricsHandler{}
+	Metrics.Setup()
 	http.Handle("/ws", &SocketHandler{})
-	http.Handle("/metrics", h)
+	http.Handle("/metrics", Metrics)
 	http.Handle("/eval", &EvalHandler{})
+	http.Handle("/eval/approve", &EvalApprovalHandler{})
+	http.Handle("/eval/pending", &PendingEvalHandler{})
 	http.Handle("/shardCount", &ExpectedShardHandler{})
 	http.Handle("/entity", &EntityHandler{})
-	http.Handle("/relay", &RelayHandler{
-		mutex:   &sync.RWMutex{},
-		clients: make(map[string]*websocket.Conn),
-	})
+	Relay = NewRelayHandler()
+	http.Handle("/relay", Relay)
+	http.Handle("/relay/clients", &RelayClientsHandler{})
+	http.Handle("/relay/peer", &PeerHandler{})
 	logrus.Infof("Starting to listen on %s:%d", Config.Ip, Config.Port)
 	if err := http.ListenAndServe(fmt.Sprintf("%s:%d", Config.Ip, Config.Port), nil); err != nil {
 		logrus.Fatalf("HTTP Listen error: %v", err)
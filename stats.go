@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The last stats a cluster reported, and when they were received.
+type clusterSnapshot struct {
+	stats   map[string]interface{}
+	updated time.Time
+}
+
+// collectLoop requests stats from every ready cluster each statsInterval, so scrapes never have to wait for clusters.
+func (h *MetricsHandler) collectLoop() {
+	ticker := time.NewTicker(time.Duration(Config.StatsInterval) * time.Second)
+	for {
+		h.collect()
+		<-ticker.C
+	}
+}
+
+// collect requests stats from every ready cluster at once, skipping clusters that pushed their stats within the last statsInterval.
+// Responses are stored by Push as they arrive.
+func (h *MetricsHandler) collect() {
+	wg := &sync.WaitGroup{}
+	for _, cluster := range Server.Clients {
+		if cluster.State != ClusterReady || h.pushedRecently(cluster) {
+			continue
+		}
+		wg.Add(1)
+		go func(cluster *Cluster) {
+			defer wg.Done()
+			if cluster.RequestStats(time.Duration(Config.StatsTimeout)*time.Millisecond) == nil {
+				logrus.Warnf("Cluster %d did not respond to a stats request in time!", cluster.ID)
+			}
+		}(cluster)
+	}
+	wg.Wait()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, cluster := range Server.Clients {
+		// Disconnected clusters no longer count towards any metric
+		if cluster.State == ClusterWaiting {
+			h.forget(cluster.ID)
+		}
+	}
+	h.update(h.sources())
+}
+
+// Forget removes the stats of a cluster that disconnected, so they no longer count towards any metric.
+// The values its counters were last at are kept, a cluster that reconnects without restarting carries on from them,
+// and one that restarted reports lower values, which are counted as a reset.
+// The sum of its increments is kept too, as increments don't start over when a cluster restarts.
+func (h *MetricsHandler) Forget(c *Cluster) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.forget(c.ID)
+	h.update(h.sources())
+}
+
+// forget is Forget with the mutex held, without updating the metrics.
+func (h *MetricsHandler) forget(id int) {
+	if _, ok := h.snapshots[id]; ok {
+		delete(h.snapshots, id)
+		h.statsAge.DeleteLabelValues(strconv.Itoa(id))
+		h.statsStale.DeleteLabelValues(strconv.Itoa(id))
+	}
+}
+
+func (h *MetricsHandler) pushedRecently(c *Cluster) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	snapshot, ok := h.snapshots[c.ID]
+	return ok && time.Since(snapshot.updated) < time.Duration(Config.StatsInterval)*time.Second
+}
+
+// Push replaces the stats of a cluster, whether they were requested or the cluster sent them on its own.
+// Metrics are updated straight away, so counters that reset between scrapes are still counted.
+func (h *MetricsHandler) Push(c *Cluster, stats map[string]interface{}) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	// Stats that were still being handled when the cluster disconnected would bring back the values it was forgotten with
+	if c.State == ClusterWaiting {
+		return
+	}
+	h.snapshots[c.ID] = &clusterSnapshot{stats: stats, updated: time.Now()}
+	h.update(h.sources())
+}
+
+// Increment adds to the counters a cluster reported, for clusters that stream how much their counters grew instead of their totals.
+// Increments are summed apart from the stats the cluster pushes, so pushing stats doesn't undo them,
+// and they don't count as pushed stats, so the cluster is still asked for the rest of its stats.
+func (h *MetricsHandler) Increment(c *Cluster, increments map[string]interface{}) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if c.State == ClusterWaiting {
+		return
+	}
+	sums, ok := h.increments[c.ID]
+	if !ok {
+		sums = make(map[string]interface{})
+		h.increments[c.ID] = sums
+	}
+	for key, inc := range increments {
+		m := h.findMetric(key)
+		if m == nil || m.Type != "counter" {
+			logrus.Warnf("Cluster %d sent an increment for %s, which is not a counter!", c.ID, key)
+			continue
+		}
+		value, err := addIncrement(copyStat(sums[key]), inc)
+		if err != nil {
+			h.statsErrors.WithLabelValues(key, strconv.Itoa(c.ID)).Inc()
+			logrus.Errorf("Cluster %d sent an invalid increment for metric %s: %s", c.ID, key, err.Error())
+			continue
+		}
+		sums[key] = value
+	}
+	h.update(h.sources())
+}
+
+// withIncrements returns a cluster's stats with the sum of its increments added to them, leaving stats as they are.
+func withIncrements(id int, stats, increments map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(stats)+len(increments))
+	for key, value := range stats {
+		merged[key] = value
+	}
+	for key, inc := range increments {
+		value, err := addIncrement(copyStat(stats[key]), inc)
+		if err != nil {
+			logrus.Errorf("Cluster %d reported metric %s in a shape that doesn't match its increments: %s", id, key, err.Error())
+			continue
+		}
+		merged[key] = value
+	}
+	return merged
+}
+
+// copyStat copies the nested objects of a value, so addIncrement can add to it without changing the original.
+func copyStat(value interface{}) interface{} {
+	data, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	copied := make(map[string]interface{}, len(data))
+	for key, child := range data {
+		copied[key] = copyStat(child)
+	}
+	return copied
+}
+
+// addIncrement adds a number, or nested objects of numbers to the current value of a counter.
+func addIncrement(current, inc interface{}) (interface{}, error) {
+	switch v := inc.(type) {
+	case float64:
+		if v < 0 {
+			return nil, fmt.Errorf("increments can't be negative, got %v", v)
+		}
+		if current == nil {
+			return v, nil
+		}
+		f, ok := current.(float64)
+		if !ok {
+			return nil, fmt.Errorf("expected a number, but the current value is %s", reflect.TypeOf(current))
+		}
+		return f + v, nil
+	case map[string]interface{}:
+		data, ok := current.(map[string]interface{})
+		if current == nil {
+			data = make(map[string]interface{})
+		} else if !ok {
+			return nil, fmt.Errorf("expected an object, but the current value is %s", reflect.TypeOf(current))
+		}
+		for key, child := range v {
+			value, err := addIncrement(data[key], child)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", key, err.Error())
+			}
+			data[key] = value
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("expected a number or an object, got %s instead", reflect.TypeOf(inc))
+}
+
+// sources returns the stats that metrics are made of, which is either every cluster's stats, or metricsSource's when metrics aren't merged or labeled by cluster.
+// Each cluster's increments are added to its stats, as long as it's connected.
+// The mutex must be held.
+func (h *MetricsHandler) sources() map[int]map[string]interface{} {
+	sources := make(map[int]map[string]interface{}, len(h.snapshots))
+	for id, snapshot := range h.snapshots {
+		if !Config.MergeMetrics && !Config.ClusterLabels && id != Config.MetricsSource {
+			continue
+		}
+		sources[id] = snapshot.stats
+	}
+	for id, increments := range h.increments {
+		if !Config.MergeMetrics && !Config.ClusterLabels && id != Config.MetricsSource {
+			continue
+		}
+		if Server.Clients[id].State == ClusterWaiting {
+			continue
+		}
+		sources[id] = withIncrements(id, sources[id], increments)
+	}
+	return sources
+}
+
+// markStale exposes how old every cluster's stats are, if they're older than statsStaleAfter, and if each cluster is up.
+// A cluster is up when it's ready and its stats aren't stale, clusters that never reported any stats are down.
+func (h *MetricsHandler) markStale() {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for id, snapshot := range h.snapshots {
+		age := time.Since(snapshot.updated)
+		stale := 0.0
+		if age > time.Duration(Config.StatsStaleAfter)*time.Second {
+			stale = 1
+		}
+		h.statsAge.WithLabelValues(strconv.Itoa(id)).Set(age.Seconds())
+		h.statsStale.WithLabelValues(strconv.Itoa(id)).Set(stale)
+	}
+	for _, cluster := range Server.Clients {
+		up := 0.0
+		snapshot, ok := h.snapshots[cluster.ID]
+		if cluster.State == ClusterReady && ok && time.Since(snapshot.updated) <= time.Duration(Config.StatsStaleAfter)*time.Second {
+			up = 1
+		}
+		h.clusterUp.WithLabelValues(strconv.Itoa(cluster.ID)).Set(up)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"testing"
+)
+
+// newTestMetrics returns a metrics handler with the metrics defined, without registering anything or collecting stats,
+// along with a single ready cluster whose stats it's given.
+func newTestMetrics(t *testing.T, metrics ...Metric) (*MetricsHandler, *Cluster) {
+	config := Config
+	t.Cleanup(func() { Config = config })
+	Config.MergeMetrics = false
+	Config.ClusterLabels = false
+	Config.MetricsSource = 0
+	h := &MetricsHandler{
+		mutex:       &sync.RWMutex{},
+		definitions: make(map[string]*Metric),
+		snapshots:   make(map[int]*clusterSnapshot),
+		increments:  make(map[int]map[string]interface{}),
+		values:      make(map[string]map[string]*sample),
+		counters: &counterTracker{
+			last:   make(map[string]sample),
+			totals: make(map[string]map[string]*sample),
+		},
+		statsAge:    prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "cluster_stats_age_seconds"}, []string{"cluster"}),
+		statsStale:  prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "cluster_stats_stale"}, []string{"cluster"}),
+		statsErrors: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "stats_errors_total"}, []string{"metric", "cluster"}),
+	}
+	for _, metric := range metrics {
+		metric := metric
+		h.definitions[metric.Name] = &metric
+	}
+	c := &Cluster{ID: 0, State: ClusterReady, mutex: &sync.Mutex{}}
+	server := Server
+	t.Cleanup(func() { Server = server })
+	Server = &WSServer{Clients: []*Cluster{c}}
+	return h, c
+}
+
+// value returns the exposed value of a metric without labels.
+func value(t *testing.T, h *MetricsHandler, metric string) float64 {
+	t.Helper()
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	s, ok := h.values[metric][labelKey(nil)]
+	if !ok {
+		t.Fatalf("metric %s has no value", metric)
+	}
+	return s.value
+}
+
+func TestCounterAcrossReconnects(t *testing.T) {
+	h, c := newTestMetrics(t, Metric{Name: "commands", Type: "counter"})
+	h.Push(c, map[string]interface{}{"commands": 100.0})
+	if v := value(t, h, "commands"); v != 100 {
+		t.Fatalf("commands = %v, want 100", v)
+	}
+
+	// A cluster that reconnects without restarting carries on from where it was
+	c.State = ClusterWaiting
+	h.Forget(c)
+	c.State = ClusterReady
+	h.Push(c, map[string]interface{}{"commands": 100.0})
+	if v := value(t, h, "commands"); v != 100 {
+		t.Errorf("commands = %v after reconnecting, want 100", v)
+	}
+	h.Push(c, map[string]interface{}{"commands": 130.0})
+	if v := value(t, h, "commands"); v != 130 {
+		t.Errorf("commands = %v, want 130", v)
+	}
+
+	// A cluster that restarted counts from 0 again
+	c.State = ClusterWaiting
+	h.Forget(c)
+	c.State = ClusterReady
+	h.Push(c, map[string]interface{}{"commands": 20.0})
+	if v := value(t, h, "commands"); v != 150 {
+		t.Errorf("commands = %v after restarting, want 150", v)
+	}
+}
+
+// Pushed totals and streamed increments of the same counter add up, without either undoing the other.
+func TestCounterPushAndIncrement(t *testing.T) {
+	h, c := newTestMetrics(t, Metric{Name: "commands", Type: "counter"})
+	Config.StatsInterval = 10
+	h.Push(c, map[string]interface{}{"commands": 10.0})
+	h.Increment(c, map[string]interface{}{"commands": 5.0})
+	if v := value(t, h, "commands"); v != 15 {
+		t.Errorf("commands = %v, want 15", v)
+	}
+	h.Push(c, map[string]interface{}{"commands": 12.0})
+	if v := value(t, h, "commands"); v != 17 {
+		t.Errorf("commands = %v after pushing again, want 17", v)
+	}
+	h.Increment(c, map[string]interface{}{"commands": 3.0})
+	if v := value(t, h, "commands"); v != 20 {
+		t.Errorf("commands = %v, want 20", v)
+	}
+	if h.snapshots[0].stats["commands"] != 12.0 {
+		t.Errorf("pushed stats changed to %v", h.snapshots[0].stats)
+	}
+}
+
+// A cluster that only streams increments is still asked for the rest of its stats.
+func TestIncrementDoesNotSkipPolling(t *testing.T) {
+	h, c := newTestMetrics(t, Metric{Name: "commands", Type: "counter"})
+	Config.StatsInterval = 10
+	h.Increment(c, map[string]interface{}{"commands": 1.0})
+	if v := value(t, h, "commands"); v != 1 {
+		t.Errorf("commands = %v, want 1", v)
+	}
+	if h.pushedRecently(c) {
+		t.Error("increments should not count as pushed stats")
+	}
+	h.Push(c, map[string]interface{}{})
+	if !h.pushedRecently(c) {
+		t.Error("pushed stats should count as pushed stats")
+	}
+}
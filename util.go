@@ -21,7 +21,7 @@ func CreateClusters(shards, clusters int) {
 			State:      ClusterWaiting,
 			pingTicker: nil,
 			mutex:      &sync.Mutex{},
-			statsChan:  make(chan map[string]interface{}),
+			statsChan:  make(chan map[string]interface{}, 1),
 		})
 	}
 }